@@ -14,18 +14,221 @@
 package main
 
 import (
+	"context"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"strings"
+
 	gas "github.com/HewlettPackard/gas/core"
 )
 
-func buildConfig() map[string]interface{} {
+// analyzer runs the gas rules over whole packages. The gas analyzer
+// type-checks every file on its own, so identifiers declared in other files
+// of the same package are unresolved and rules relying on type information
+// miss findings.
+type analyzer struct {
+	Issues []taggedIssue `json:"issues"`
+	Stats  gas.Metrics   `json:"metrics"`
+
+	// Config is the scan configuration that was applied
+	Config *scanConfig `json:"config"`
+
+	fset     *token.FileSet
+	config   map[string]interface{}
+	ruleset  map[reflect.Type][]taggedRule
+	importer types.Importer
+}
+
+// A taggedRule is a rule along with its ID, e.g. G101.
+type taggedRule struct {
+	id   string
+	rule gas.Rule
+}
+
+// A taggedIssue is an issue along with the ID of the rule that found it.
+type taggedIssue struct {
+	gas.Issue
+	Rule string `json:"rule"`
+}
+
+func buildConfig(cfg *scanConfig) map[string]interface{} {
 	config := map[string]interface{}{}
-	config["ignoreNosec"] = false
+	config["ignoreNosec"] = !cfg.Nosec
 	return config
 }
 
-func buildAnalyzer() *gas.Analyzer {
-	config := buildConfig()
-	analyzer := gas.NewAnalyzer(config, logger)
-	addRules(&analyzer, config)
-	return &analyzer
+func buildAnalyzer(cfg *scanConfig) *analyzer {
+	config := buildConfig(cfg)
+	a := &analyzer{
+		Issues:   []taggedIssue{},
+		Config:   cfg,
+		fset:     token.NewFileSet(),
+		config:   config,
+		ruleset:  map[reflect.Type][]taggedRule{},
+		importer: importer.Default(),
+	}
+	addRules(a, config)
+	return a
+}
+
+// addRule runs r on every node of the same type as n. Issues it finds are
+// tagged with id.
+func (a *analyzer) addRule(id string, r gas.Rule, n ast.Node) {
+	t := reflect.TypeOf(n)
+	a.ruleset[t] = append(a.ruleset[t], taggedRule{id, r})
+}
+
+// A sourcePackage is a set of files in the same directory with the same
+// package clause.
+type sourcePackage struct {
+	// path is the directory of the package, relative to the tree
+	path  string
+	files []*ast.File
+}
+
+// parsePackages parses the files of a tree and groups them into packages,
+// in the order they first appear in. Files that don't parse are skipped,
+// the rest are still worth analysing.
+func (a *analyzer) parsePackages(ctx context.Context, tree *sourceTree) ([]*sourcePackage, error) {
+	pkgs := []*sourcePackage{}
+	index := map[string]*sourcePackage{}
+	for _, name := range tree.files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		file, err := parser.ParseFile(a.fset, filepath.Join(tree.dir, name), nil, parser.ParseComments)
+		if err != nil {
+			logger.Printf("unable to analyse %s: %s", name, err)
+			continue
+		}
+
+		dir := filepath.ToSlash(filepath.Dir(name))
+		key := dir + " " + file.Name.Name
+		pkg, ok := index[key]
+		if !ok {
+			pkg = &sourcePackage{path: dir}
+			index[key] = pkg
+			pkgs = append(pkgs, pkg)
+		}
+		pkg.files = append(pkg.files, file)
+	}
+	return pkgs, nil
+}
+
+// checkPackage type-checks the files of a package as a unit and runs the
+// rules over each of them. It gives up as soon as ctx is done.
+func (a *analyzer) checkPackage(ctx context.Context, pkg *sourcePackage) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
+		Implicits:  make(map[ast.Node]types.Object),
+	}
+
+	// Dependencies may well be missing, type errors are expected and only
+	// leave some types unknown
+	conf := types.Config{Importer: a.importer, FakeImportC: true, Error: func(error) {}}
+	checked, _ := conf.Check(pkg.path, a.fset, pkg.files, info)
+
+	for _, file := range pkg.files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c := &gas.Context{
+			FileSet:  a.fset,
+			Comments: ast.NewCommentMap(a.fset, file, file.Comments),
+			Info:     info,
+			Pkg:      fileImports(checked, file, info),
+			Root:     file,
+			Config:   a.config,
+		}
+		ast.Walk(&fileVisitor{a, c, ctx.Done()}, file)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		a.Stats.NumFiles++
+		a.Stats.NumLines += a.fset.File(file.Pos()).LineCount()
+	}
+	return nil
+}
+
+// fileImports returns a copy of pkg that only imports what file imports.
+// Rules look at the imports of the package to tell what a name in the file
+// refers to, imports in other files must not count.
+func fileImports(pkg *types.Package, file *ast.File, info *types.Info) *types.Package {
+	imports := []*types.Package{}
+	for _, spec := range file.Imports {
+		obj := info.Implicits[spec]
+		if spec.Name != nil {
+			obj = info.Defs[spec.Name]
+		}
+		if name, ok := obj.(*types.PkgName); ok {
+			imports = append(imports, name.Imported())
+		}
+	}
+
+	view := types.NewPackage(pkg.Path(), pkg.Name())
+	view.SetImports(imports)
+	return view
+}
+
+// A fileVisitor runs the rules over the nodes of a file, until done is
+// closed.
+type fileVisitor struct {
+	analyzer *analyzer
+	context  *gas.Context
+	done     <-chan struct{}
+}
+
+func (v *fileVisitor) Visit(n ast.Node) ast.Visitor {
+	select {
+	case <-v.done:
+		return nil
+	default:
+	}
+	if v.ignore(n) {
+		return nil
+	}
+
+	for _, tagged := range v.analyzer.ruleset[reflect.TypeOf(n)] {
+		found, err := tagged.rule.Match(n, v.context)
+		if err != nil {
+			logger.Printf("internal error running rule %s: %s", tagged.id, err)
+		}
+		if found != nil {
+			found.Severity = v.analyzer.Config.severity(tagged.id, found.Severity)
+			v.analyzer.Issues = append(v.analyzer.Issues, taggedIssue{*found, tagged.id})
+			v.analyzer.Stats.NumFound++
+		}
+	}
+	return v
+}
+
+// ignore tells if a node, and all nodes below it, are tagged with a nosec
+// comment.
+func (v *fileVisitor) ignore(n ast.Node) bool {
+	if ignoreNosec, _ := v.context.Config["ignoreNosec"].(bool); ignoreNosec {
+		return false
+	}
+	for _, group := range v.context.Comments[n] {
+		if strings.Contains(group.Text(), "nosec") {
+			v.analyzer.Stats.NumNosec++
+			return true
+		}
+	}
+	return false
 }
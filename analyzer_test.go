@@ -0,0 +1,207 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gas "github.com/HewlettPackard/gas/core"
+)
+
+// analyzeSources runs the analyzer over files, a map from slash-separated
+// paths to their content.
+func analyzeSources(t *testing.T, a *analyzer, files map[string]string) []*sourcePackage {
+	dir, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree, err := extractArchive(context.Background(), bytes.NewReader(buildTarball(t, "project", "", files)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := a.parsePackages(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		if err := a.checkPackage(context.Background(), pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pkgs
+}
+
+func TestAnalyzerRules(t *testing.T) {
+	a := buildAnalyzer(defaultScanConfig())
+	analyzeSources(t, a, map[string]string{"main.go": insecureSource})
+
+	found := map[string]bool{}
+	for _, i := range a.Issues {
+		if i.Rule == "" {
+			t.Errorf("issue without rule: %+v", i)
+		}
+		found[i.Rule] = true
+	}
+	if len(found) != 2 || !found["G401"] || !found["G501"] {
+		t.Fatalf("expected G401 and G501 findings, got %v", found)
+	}
+}
+
+func TestAnalyzerUncheckedErrors(t *testing.T) {
+	a := buildAnalyzer(defaultScanConfig())
+	analyzeSources(t, a, map[string]string{
+		"main.go": `package main
+
+import "os"
+
+func main() {
+	n, _ := os.Stdout.Write([]byte("a"))
+	_ = os.Remove("b")
+	if err := os.Remove("c"); err != nil {
+		panic(err)
+	}
+	_ = n
+}
+`,
+	})
+
+	// Errors assigned to the blank identifier are reported
+	lines := map[int]bool{}
+	for _, found := range a.Issues {
+		if found.Rule != "G104" {
+			t.Errorf("unexpected issue %+v", found)
+		}
+		lines[found.Line] = true
+	}
+	if len(lines) != 2 || !lines[6] || !lines[7] {
+		t.Fatalf("expected unchecked errors on lines 6 and 7, got %v", a.Issues)
+	}
+}
+
+// typeRecorder records the type of every call to a function named target.
+type typeRecorder struct {
+	target string
+	types  []string
+}
+
+func (r *typeRecorder) Match(n ast.Node, c *gas.Context) (*gas.Issue, error) {
+	call := n.(*ast.CallExpr)
+	if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == r.target {
+		if t := c.Info.Types[call].Type; t != nil {
+			r.types = append(r.types, t.String())
+		}
+	}
+	return nil, nil
+}
+
+func TestAnalyzerPackages(t *testing.T) {
+	a := buildAnalyzer(defaultScanConfig())
+	recorder := &typeRecorder{target: "open"}
+	a.addRule("", recorder, (*ast.CallExpr)(nil))
+
+	pkgs := analyzeSources(t, a, map[string]string{
+		"open.go": "package store\nimport \"os\"\nfunc open() (*os.File, error) { return nil, nil }\n",
+		"use.go":  "package store\nfunc use() { f, _ := open(); _ = f }\n",
+		"rand.go": "package store\nimport \"math/rand\"\nfunc roll() int { return rand.Intn(6) }\n",
+		"key.go":  "package store\nimport \"crypto/rand\"\nfunc key(b []byte) { rand.Read(b) }\n",
+
+		// Other package clauses and directories are checked on their own
+		"main.go":       insecureSource,
+		"cmd/tool/x.go": "package main\nfunc open() int { return 0 }\nvar _ = open()\n",
+	})
+
+	if len(pkgs) != 3 {
+		t.Fatalf("expected 3 packages, got %d", len(pkgs))
+	}
+
+	// Calls in use.go resolve to the declaration in open.go
+	expected := map[string]bool{"(*os.File, error)": true, "int": true}
+	if len(recorder.types) != 2 || !expected[recorder.types[0]] || !expected[recorder.types[1]] {
+		t.Fatalf("unexpected types of calls %v", recorder.types)
+	}
+
+	// The error returned by open is only known from open.go, and crypto/rand
+	// in key.go isn't mistaken for math/rand in rand.go
+	unchecked := 0
+	for _, found := range a.Issues {
+		if found.Rule == "G104" && filepath.Base(found.File) == "use.go" {
+			unchecked++
+		}
+		if found.Rule == "G404" {
+			t.Errorf("unexpected weak random finding in %s", found.File)
+		}
+	}
+	if unchecked != 1 {
+		t.Errorf("expected unchecked error in use.go, got %v", a.Issues)
+	}
+	if a.Stats.NumFiles != 6 {
+		t.Errorf("expected 6 files, got %d", a.Stats.NumFiles)
+	}
+}
+
+// cancellingRule cancels a scan as soon as it sees a call.
+type cancellingRule struct {
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (r *cancellingRule) Match(n ast.Node, c *gas.Context) (*gas.Issue, error) {
+	r.calls++
+	r.cancel()
+	return nil, nil
+}
+
+func TestAnalyzerCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{}
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		files[name] = "package calls\nfunc f() { g(); g(); g() }\nfunc g() {}\n"
+	}
+	tree, err := extractArchive(context.Background(), bytes.NewReader(buildTarball(t, "project", "", files)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := buildAnalyzer(defaultScanConfig())
+	rule := &cancellingRule{cancel: cancel}
+	a.addRule("", rule, (*ast.CallExpr)(nil))
+
+	pkgs, err := a.parsePackages(context.Background(), tree)
+	if err != nil || len(pkgs) != 1 {
+		t.Fatalf("unexpected packages %v (%v)", pkgs, err)
+	}
+
+	// The scan stops within the file it was cancelled in
+	if err := a.checkPackage(ctx, pkgs[0]); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if rule.calls != 1 || a.Stats.NumFiles != 0 {
+		t.Errorf("expected scan to stop, got %d calls in %d files", rule.calls, a.Stats.NumFiles)
+	}
+}
@@ -5,6 +5,12 @@ function cleanupIssueType(details) {
     return (details.charAt(0).toUpperCase() + details.slice(1)).replace(/\.$/, "");
 }
 
+// issueRule returns the ID of the rule behind an issue. Results stored
+// before rule IDs were recorded fall back to the issue type.
+function issueRule(issue) {
+  return issue.rule || cleanupIssueType(issue.details).split(".")[0];
+}
+
 var IssueTag = React.createClass({
   render: function() {
     var level = ""
@@ -40,19 +46,26 @@ var Issue = React.createClass({
           <IssueTag label="Confidence" level={ this.props.data.confidence }/>
         </div>
         <p>
-          <strong>
-            <a className="icon borderless is-pulled-right"
-               href={ this.props.path + "/" + this.props.data.file + "#L" + this.props.data.line }
-               alt="Jump to code">
-               <i className="fa fa-code" aria-hidden="true"></i>
-            </a>
-            <a className="issue-title borderless"
-               href={ this.props.path + "/" + this.props.data.file + "#L" + this.props.data.line }>
-               { this.props.data.file } (line { this.props.data.line })
-            </a>
-          </strong>
+          { this.props.links ? (
+            <strong>
+              <a className="icon borderless is-pulled-right"
+                 href={ fileLink(this.props.links, this.props.data) }
+                 alt="Jump to code">
+                 <i className="fa fa-code" aria-hidden="true"></i>
+              </a>
+              <a className="issue-title borderless"
+                 href={ fileLink(this.props.links, this.props.data) }>
+                 { this.props.data.file } (line { this.props.data.line })
+              </a>
+            </strong>
+          ) : (
+            <strong className="issue-title">
+              { this.props.data.file } (line { this.props.data.line })
+            </strong>
+          ) }
           <br/>
-          { cleanupIssueType(this.props.data.details) }
+          { this.props.data.rule ? <span className="tag">{ this.props.data.rule }</span> : "" }
+          { " " + cleanupIssueType(this.props.data.details) }
         </p>
         <figure className="highlight">
           <pre>
@@ -72,7 +85,8 @@ var Stats = React.createClass({
       <p className="help">
         Last updated { new Date(this.props.data.time).toLocaleString() }.
         Scanned { this.props.data.results.metrics.files.toLocaleString() } files
-        with { this.props.data.results.metrics.lines.toLocaleString() } lines of code.
+        with { this.props.data.results.metrics.lines.toLocaleString() } lines of code
+        { this.props.data.commit ? " at commit " + this.props.data.commit.substring(0, 7) : "" }.
       </p>
     );
   }
@@ -99,13 +113,9 @@ var Issues = React.createClass({
       );
     }
 
-    var tag = this.props.data.tag;
-    if (!tag) {
-      tag = "master";
-    }
-
-    var repoPath =
-      "https://" + this.props.data.repo  + "/blob/" + tag;
+    // The server links to the scanned commit in the URL layout of the
+    // host, and leaves links out for sources that can't be browsed
+    var links = this.props.data.links;
 
     var issues = this.props.data.results.issues
       .filter(function(issue) {
@@ -115,14 +125,10 @@ var Issues = React.createClass({
         return this.props.confidence.includes(issue.confidence);
       }.bind(this))
       .filter(function(issue) {
-        if (this.props.issueType) {
-          return issue.details.toLowerCase().startsWith(this.props.issueType.toLowerCase());
-        } else {
-          return true
-        }
+        return !this.props.rule || issueRule(issue) == this.props.rule;
       }.bind(this))
       .map(function(issue) {
-        return (<Issue path={repoPath} data={issue} />);
+        return (<Issue links={links} data={issue} />);
       }.bind(this));
 
     if (issues.length === 0) {
@@ -200,19 +206,19 @@ var Navigation = React.createClass({
   updateConfidence: function(vals) {
     this.props.onConfidence(vals);
   },
-  updateIssueType: function(e) {
+  updateRule: function(e) {
     if (e.target.value == "all") {
-      this.props.onIssueType(null);
+      this.props.onRule(null);
     } else {
-      this.props.onIssueType(e.target.value);
+      this.props.onRule(e.target.value);
     }
   },
   render: function() {
-    var issueTypes = this.props.allIssueTypes
-      .map(function(it) {
+    var rules = this.props.allRules
+      .map(function(rule) {
         return (
-          <option value={ it } selected={ this.props.issueType == it }>
-            { it }
+          <option value={ rule.id } selected={ this.props.rule == rule.id }>
+            { rule.label }
           </option>
         );
       }.bind(this));
@@ -255,15 +261,15 @@ var Navigation = React.createClass({
             <i className="fa fa-info-circle"></i>
           </span>
           <strong>
-            Issue Type
+            Rule
           </strong>
         </div>
         <div className="panel-block">
-          <select onChange={ this.updateIssueType }>
-            <option value="all" selected={ !this.props.issueType }>
+          <select onChange={ this.updateRule }>
+            <option value="all" selected={ !this.props.rule }>
               (all)
             </option>
-            { issueTypes }
+            { rules }
           </select>
         </div>
       </nav>
@@ -283,15 +289,15 @@ var IssueBrowser = React.createClass({
     this.loadIssues(nextProps.repo);
   },
   handleSeverity: function(val) {
-    this.updateIssueTypes(this.state.data.results.issues, val, this.state.confidence);
+    this.updateRules(this.state.data.results.issues, val, this.state.confidence);
     this.setState({severity: val});
   },
   handleConfidence: function(val) {
-    this.updateIssueTypes(this.state.data.results.issues, this.state.severity, val);
+    this.updateRules(this.state.data.results.issues, this.state.severity, val);
     this.setState({confidence: val});
   },
-  handleIssueType: function(val) {
-    this.setState({issueType: val});
+  handleRule: function(val) {
+    this.setState({rule: val});
   },
   loadIssues: function(repo) {
     reqwest({
@@ -339,7 +345,7 @@ var IssueBrowser = React.createClass({
       selectedConfidences = selectedConfidences.filter(function(i) { return i != "LOW" });
     }
 
-    this.updateIssueTypes(data.results.issues, selectedSeverities, selectedConfidences);
+    this.updateRules(data.results.issues, selectedSeverities, selectedConfidences);
 
     this.setState({
       data: data,
@@ -347,11 +353,11 @@ var IssueBrowser = React.createClass({
       allSeverities: allSeverities,
       confidence: selectedConfidences,
       allConfidences: allConfidences,
-      issueType: null
+      rule: null
     });
   },
-  updateIssueTypes: function(issues, severities, confidences) {
-    var allTypes = issues
+  updateRules: function(issues, severities, confidences) {
+    var allRules = issues
       .filter(function(issue) {
         return severities.includes(issue.severity);
       })
@@ -359,18 +365,23 @@ var IssueBrowser = React.createClass({
         return confidences.includes(issue.confidence);
       })
       .map(function(issue) {
-        return cleanupIssueType(issue.details).split(".")[0];
+        var id = issueRule(issue);
+        var label = issue.rule ? id + ": " + cleanupIssueType(issue.details).split(".")[0] : id;
+        return { id: id, label: label };
+      })
+      .sort(function(a, b) {
+        return a.id < b.id ? -1 : (a.id > b.id ? 1 : 0);
       })
-      .sort()
       .filter(function(item, pos, ary) {
-        return !pos || item != ary[pos - 1];
+        return !pos || item.id != ary[pos - 1].id;
       });
 
-    if (this.state.issueType && !allTypes.includes(this.state.issueType)) {
-      this.setState({issueType: null});
+    var ids = allRules.map(function(rule) { return rule.id; });
+    if (this.state.rule && !ids.includes(this.state.rule)) {
+      this.setState({rule: null});
     }
 
-    this.setState({allIssueTypes: allTypes});
+    this.setState({allRules: allRules});
   },
   render: function() {
     if (this.state.error) {
@@ -397,9 +408,11 @@ var IssueBrowser = React.createClass({
       <div className="content">
         <h2 className="subtitle">
           results for { this.state.data.repo }
-          <a href={ "https://" + this.state.data.repo } className="icon is-pulled-right borderless">
-            <i className="fa fa-github-alt" aria-hidden="true"></i>
-          </a>
+          { this.state.data.links ? (
+            <a href={ this.state.data.links.repo } className="icon is-pulled-right borderless">
+              <i className={ "fa " + hostIcon(this.state.data.repo) } aria-hidden="true"></i>
+            </a>
+          ) : "" }
         </h2>
         <hr/>
         <div className="columns">
@@ -407,13 +420,13 @@ var IssueBrowser = React.createClass({
             <Navigation
               severity={ this.state.severity } 
               confidence={ this.state.confidence }
-              issueType={ this.state.issueType }
+              rule={ this.state.rule }
               allSeverities={ this.state.allSeverities } 
               allConfidences={ this.state.allConfidences }
-              allIssueTypes={ this.state.allIssueTypes }
+              allRules={ this.state.allRules }
               onSeverity={ this.handleSeverity } 
               onConfidence={ this.handleConfidence } 
-              onIssueType={ this.handleIssueType }
+              onRule={ this.handleRule }
             />
           </div>
           <div className="column is-three-quarters">
@@ -421,7 +434,7 @@ var IssueBrowser = React.createClass({
               data={ this.state.data }
               severity={ this.state.severity }
               confidence={ this.state.confidence }
-              issueType={ this.state.issueType }
+              rule={ this.state.rule }
             />
           </div>
         </div>
@@ -430,12 +443,43 @@ var IssueBrowser = React.createClass({
   }
 });
 
+// fileLink fills in the file and line of an issue in the link template of
+// a repository.
+function fileLink(links, issue) {
+  return links.file
+    .replace("{file}", issue.file.split("/").map(encodeURIComponent).join("/"))
+    .replace("{line}", issue.line);
+}
+
+// hostIcon picks the icon for links to the host of a repository.
+function hostIcon(repo) {
+  if (repo.startsWith("github.com/")) {
+    return "fa-github-alt";
+  } else if (repo.startsWith("bitbucket.org/")) {
+    return "fa-bitbucket";
+  }
+  return "fa-gitlab";
+}
+
 var RepoSelector = React.createClass({
   getInitialState: function() {
-    return { repo: "", valid: true };
+    return { repo: "", valid: true, login: undefined };
+  },
+  componentDidMount: function() {
+    // Signing in is only possible if OAuth is configured on the backend
+    reqwest({
+      url: "/session",
+      type: "json",
+      success: function(data) {
+        this.setState({login: data.login});
+      }.bind(this),
+      error: function(xhr) {
+        this.setState({login: xhr.status == 401 ? "" : undefined});
+      }.bind(this)
+    });
   },
   updateRepo: function(e) {
-    var re = /^[a-zA-Z-0-9-_.]+\/[a-zA-Z-0-9-_.]+$/;
+    var re = /^[a-zA-Z-0-9-_.]+\/[a-zA-Z-0-9-_.]+(@[a-zA-Z-0-9-_.]+(\/[a-zA-Z-0-9-_.]+)*)?$/;
     this.setState({
       repo: e.target.value.trim(),
       valid: this.state.valid || re.test(e.target.value.trim())
@@ -443,7 +487,7 @@ var RepoSelector = React.createClass({
   },
   submitForm: function(e) {
     e.preventDefault();
-    var re = /^[a-zA-Z-0-9-_.]+\/[a-zA-Z-0-9-_.]+$/;
+    var re = /^[a-zA-Z-0-9-_.]+\/[a-zA-Z-0-9-_.]+(@[a-zA-Z-0-9-_.]+(\/[a-zA-Z-0-9-_.]+)*)?$/;
     var valid = re.test(this.state.repo);
     if (!valid) {
       this.setState({valid: valid});
@@ -470,6 +514,24 @@ var RepoSelector = React.createClass({
       );
     }
 
+    if (this.state.login) {
+      var account = (
+        <form method="post" action="/logout">
+          <p>
+            Signed in as { this.state.login }, private repositories you can
+            read will be scanned as well.
+            <button className="button is-link" type="submit">Sign out</button>
+          </p>
+        </form>
+      );
+    } else if (this.state.login === "") {
+      var account = (
+        <p>
+          To scan a private repository, <a href="/login">sign in with GitHub</a> first.
+        </p>
+      );
+    }
+
     return (
       <div className="content">
         <h2 className="subtitle">
@@ -499,6 +561,7 @@ var RepoSelector = React.createClass({
             { warning }
           </p>
         </form>
+        { account }
       </div>
     );
   }
@@ -0,0 +1,328 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	gas "github.com/HewlettPackard/gas/core"
+	"github.com/go-errors/errors"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+const (
+	// configFile is the name of the scan configuration in the root of a
+	// repository
+	configFile = ".gas.yml"
+
+	// configLimit is the maximum size of a configuration file
+	configLimit = 64 << 10
+)
+
+var severities = map[string]gas.Score{
+	"LOW":    gas.Low,
+	"MEDIUM": gas.Medium,
+	"HIGH":   gas.High,
+}
+
+// A scanConfig tunes how a repository is scanned. Maintainers can put a
+// .gas.yml file in the root of their repository, e.g.
+//
+//	exclude:
+//	  - internal/generated
+//	  - "*.pb.go"
+//	rules:
+//	  disable:
+//	    - G104
+//	severity:
+//	  G101: LOW
+//	nosec: false
+//	tests: true
+//
+// Excluded paths are directories, files or glob patterns. Rules are all
+// enabled unless some are listed under enable, and disabled ones are
+// dropped. Issues of rules with a severity override get that severity.
+// #nosec comments are honoured unless nosec is false, and tests are only
+// analysed if tests is true.
+//
+// The configuration that was applied is recorded in the results.
+type scanConfig struct {
+	Exclude  []string          `json:"exclude"`
+	Enable   []string          `json:"enable"`
+	Disable  []string          `json:"disable"`
+	Severity map[string]string `json:"severity"`
+	Nosec    bool              `json:"nosec"`
+	Tests    bool              `json:"tests"`
+
+	// Error explains why the configuration file was ignored, if it was
+	Error string `json:"error,omitempty"`
+
+	rules *ruleSelection
+}
+
+func defaultScanConfig() *scanConfig {
+	return &scanConfig{
+		Exclude:  []string{},
+		Enable:   []string{},
+		Disable:  []string{},
+		Severity: map[string]string{},
+		Nosec:    true,
+	}
+}
+
+// readScanConfig reads the configuration in the root of a tree. Without a
+// configuration file, or with an invalid one, defaults apply.
+func readScanConfig(dir string) *scanConfig {
+	file, err := os.Open(filepath.Join(dir, configFile))
+	if err != nil {
+		return defaultScanConfig()
+	}
+	defer file.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(file, configLimit+1))
+	if err == nil && len(raw) > configLimit {
+		err = errors.Errorf("%s is larger than %d bytes", configFile, configLimit)
+	}
+	if err == nil {
+		var cfg *scanConfig
+		if cfg, err = parseScanConfig(raw); err == nil {
+			return cfg
+		}
+	}
+
+	cfg := defaultScanConfig()
+	cfg.Error = err.Error()
+	return cfg
+}
+
+// parseScanConfig parses a configuration file. Unknown settings are an
+// error, they are most likely typos.
+func parseScanConfig(raw []byte) (*scanConfig, error) {
+	cfg := defaultScanConfig()
+	node, err := yaml.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Errorf("invalid %s: %s", configFile, err)
+	}
+	if node == nil {
+		return cfg, nil
+	}
+	settings, ok := node.(yaml.Map)
+	if !ok {
+		return nil, errors.Errorf("invalid %s: expected a mapping of settings", configFile)
+	}
+
+	for key, value := range settings {
+		switch key {
+		case "exclude":
+			cfg.Exclude, err = yamlList(value)
+		case "rules":
+			err = parseRuleConfig(cfg, value)
+		case "severity":
+			err = parseSeverityConfig(cfg, value)
+		case "nosec":
+			cfg.Nosec, err = yamlBool(value)
+		case "tests":
+			cfg.Tests, err = yamlBool(value)
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return nil, errors.Errorf("invalid %s: %s: %s", configFile, key, err)
+		}
+	}
+
+	for i, pattern := range cfg.Exclude {
+		cfg.Exclude[i] = strings.Trim(strings.TrimPrefix(pattern, "./"), "/")
+		if _, err := path.Match(cfg.Exclude[i], ""); err != nil || cfg.Exclude[i] == "" {
+			return nil, errors.Errorf("invalid %s: exclude: invalid pattern %q", configFile, pattern)
+		}
+	}
+	return cfg, nil
+}
+
+func parseRuleConfig(cfg *scanConfig, node yaml.Node) error {
+	rules, ok := node.(yaml.Map)
+	if !ok {
+		return errors.New("expected enable and disable lists")
+	}
+
+	var err error
+	for key, value := range rules {
+		switch key {
+		case "enable":
+			cfg.Enable, err = yamlList(value)
+		case "disable":
+			cfg.Disable, err = yamlList(value)
+		default:
+			err = errors.Errorf("unknown setting %s", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sel := &ruleSelection{}
+	if sel.include, err = parseRuleIDs(strings.Join(cfg.Enable, ",")); err != nil {
+		return err
+	}
+	if sel.exclude, err = parseRuleIDs(strings.Join(cfg.Disable, ",")); err != nil {
+		return err
+	}
+	cfg.Enable, cfg.Disable = ruleIDs(sel.include), ruleIDs(sel.exclude)
+	cfg.rules = sel
+	return nil
+}
+
+func parseSeverityConfig(cfg *scanConfig, node yaml.Node) error {
+	overrides, ok := node.(yaml.Map)
+	if !ok {
+		return errors.New("expected a mapping of rules to severities")
+	}
+
+	for id, value := range overrides {
+		scalar, ok := value.(yaml.Scalar)
+		if !ok {
+			return errors.Errorf("expected a severity for %s", id)
+		}
+		id = strings.ToUpper(id)
+		if _, ok := allRules[id]; !ok {
+			return errors.Errorf("unknown rule %s", id)
+		}
+		severity := strings.ToUpper(scalarValue(scalar))
+		if _, ok := severities[severity]; !ok {
+			return errors.Errorf("unknown severity %s", severity)
+		}
+		cfg.Severity[id] = severity
+	}
+	return nil
+}
+
+// filter returns the files of a tree to analyse, leaving out excluded ones
+// and adding tests if asked to.
+func (cfg *scanConfig) filter(tree *sourceTree) []string {
+	candidates := tree.files
+	if cfg.Tests {
+		candidates = append(candidates[:len(candidates):len(candidates)], tree.tests...)
+	}
+
+	files := []string{}
+	for _, name := range candidates {
+		if !cfg.excluded(filepath.ToSlash(name)) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// excluded tells if the file at name, a slash-separated path relative to
+// the root, is excluded from the scan.
+func (cfg *scanConfig) excluded(name string) bool {
+	for _, pattern := range cfg.Exclude {
+		// Patterns without a slash match in any directory
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(name)); ok {
+				return true
+			}
+		}
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// severity returns the severity of issues found by a rule.
+func (cfg *scanConfig) severity(id string, found gas.Score) gas.Score {
+	if override, ok := cfg.Severity[id]; ok {
+		return severities[override]
+	}
+	return found
+}
+
+// yamlList reads a list of strings, which may also be written as a single
+// comma-separated value like "[G101, G104]".
+func yamlList(node yaml.Node) ([]string, error) {
+	values := []string{}
+	switch node := node.(type) {
+	case yaml.List:
+		for _, item := range node {
+			scalar, ok := item.(yaml.Scalar)
+			if !ok {
+				return nil, errors.New("expected a list of values")
+			}
+			values = append(values, scalarValue(scalar))
+		}
+	case yaml.Scalar:
+		list := strings.TrimSuffix(strings.TrimPrefix(scalarValue(node), "["), "]")
+		for _, value := range strings.Split(list, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, scalarValue(yaml.Scalar(value)))
+			}
+		}
+	case nil:
+	default:
+		return nil, errors.New("expected a list of values")
+	}
+	return values, nil
+}
+
+func yamlBool(node yaml.Node) (bool, error) {
+	scalar, ok := node.(yaml.Scalar)
+	if !ok {
+		return false, errors.New("expected true or false")
+	}
+	switch value := strings.ToLower(scalarValue(scalar)); value {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	default:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, errors.New("expected true or false")
+		}
+		return b, nil
+	}
+}
+
+// scalarValue returns a scalar without surrounding quotes.
+func scalarValue(s yaml.Scalar) string {
+	value := strings.TrimSpace(string(s))
+	if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+		return unquoted
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func ruleIDs(set map[string]bool) []string {
+	ids := []string{}
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScanConfig(t *testing.T) {
+	cfg, err := parseScanConfig([]byte(`# scan settings
+exclude:
+  - ./gen/
+  - "*.pb.go"
+rules:
+  enable: [g401, G501]
+  disable:
+    - G501
+severity:
+  g401: low
+nosec: off
+tests: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Exclude) != 2 || cfg.Exclude[0] != "gen" || cfg.Exclude[1] != "*.pb.go" {
+		t.Errorf("unexpected excluded paths %v", cfg.Exclude)
+	}
+	if !cfg.rules.enabled("G401") || cfg.rules.enabled("G501") || cfg.rules.enabled("G101") {
+		t.Errorf("unexpected rules %v, %v", cfg.Enable, cfg.Disable)
+	}
+	if cfg.Severity["G401"] != "LOW" || cfg.Nosec || !cfg.Tests {
+		t.Errorf("unexpected configuration %+v", cfg)
+	}
+
+	for name, excluded := range map[string]bool{
+		"gen/x.go":        true,
+		"gen":             true,
+		"api/api.pb.go":   true,
+		"generated/x.go":  false,
+		"internal/gen.go": false,
+	} {
+		if cfg.excluded(name) != excluded {
+			t.Errorf("expected %s to be excluded: %v", name, excluded)
+		}
+	}
+
+	for _, invalid := range []string{
+		"- a list\n",
+		"unknown: true\n",
+		"tests: maybe\n",
+		"rules:\n  disable:\n    - G999\n",
+		"severity:\n  G101: CRITICAL\n",
+		"exclude:\n  - \"[\"\n",
+	} {
+		if _, err := parseScanConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+
+	if cfg, err := parseScanConfig(nil); err != nil || !cfg.Nosec || cfg.Tests {
+		t.Errorf("unexpected defaults %+v (%v)", cfg, err)
+	}
+}
+
+func TestAnalyzeConfigured(t *testing.T) {
+	sources := map[string]string{
+		"main.go":      insecureSource,
+		"main_test.go": insecureSource,
+		"gen/gen.go":   insecureSource,
+		"nosec.go":     "package main\nimport \"crypto/md5\"\nvar sum = md5.Sum(nil) // #nosec\n",
+	}
+	w := newTestWorker(nil)
+	analyze := func(config string) *analyzer {
+		dir, err := ioutil.TempDir("", "gas-web-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		sources[configFile] = config
+		tree, err := extractArchive(context.Background(), bytes.NewReader(buildTarball(t, "project", "", sources)), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, _, err := w.analyzeTree(context.Background(), tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	a := analyze("exclude:\n  - gen\nrules:\n  disable:\n    - G501\nseverity:\n  G401: LOW\nnosec: false\ntests: true\n")
+	found := map[string]bool{}
+	for _, i := range a.Issues {
+		if i.Rule != "G401" || i.Severity.String() != "LOW" {
+			t.Errorf("unexpected issue %+v", i)
+		}
+		found[i.File] = true
+	}
+	if len(found) != 3 || !found["main.go"] || !found["main_test.go"] || !found["nosec.go"] {
+		t.Errorf("unexpected findings in %v", found)
+	}
+
+	// The applied configuration is recorded in the results
+	doc, err := buildDocument(time.Now(), &scan{Path: "local/project"}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := gzip.NewReader(bytes.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Results struct {
+			Config scanConfig `json:"config"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(unzipped).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := res.Results.Config; !cfg.Tests || cfg.Nosec || len(cfg.Disable) != 1 || cfg.Severity["G401"] != "LOW" {
+		t.Errorf("unexpected recorded configuration %+v", cfg)
+	}
+
+	// Invalid configurations are ignored
+	a = analyze("tests: maybe\n")
+	if !strings.Contains(a.Config.Error, "tests") {
+		t.Errorf("expected configuration error, got %q", a.Config.Error)
+	}
+	for _, i := range a.Issues {
+		if i.File != "main.go" && i.File != "gen/gen.go" {
+			t.Errorf("unexpected issue in %s", i.File)
+		}
+	}
+}
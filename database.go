@@ -16,17 +16,28 @@ package main
 import (
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
+	"bitbucket.org/liamstask/goose/lib/goose"
 	"github.com/go-errors/errors"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// errStaleLock is returned when a write is fenced off because another node
+// acquired the lock of the path in the meantime.
+var errStaleLock = errors.New("stale lock, a newer lock holder exists")
+
 type lock interface {
 	unlock() error
 	refresh() error
+
+	// token returns the lock generation, a fencing token that increases
+	// with every acquisition of any lock.
+	token() int64
 }
 
 type database interface {
@@ -34,39 +45,319 @@ type database interface {
 	lockPath(node, path string, lifetime time.Duration) (lock, error)
 	isLocked(path string) (bool, error)
 
-	// Results storage
-	storeResults(path, etag, results string, missing bool) error
-	fetchResults(path string) (time.Time, string, string, bool, error)
-	updateTimestamp(path string) error
+	// Results storage. Writes carry the token of the lock they were made
+	// under and fail with errStaleLock if a newer lock holder exists.
+	storeResults(s *scan, token int64) error
+	fetchResults(path string) (*scan, error)
+	updateTimestamp(path string, token int64) error
+
+	// Scan history
+	listScans(path string, limit int) ([]*scan, error)
+	fetchScan(path string, id int64) (*scan, error)
+
+	// findScanByCommit returns the most recent successful scan of a commit
+	// with the given rule set, of any repository, including its issues.
+	// Returns sql.ErrNoRows if there is none.
+	findScanByCommit(commit, ruleSet string) (*scan, error)
+
+	// Issue queries, across the most recent scan of every repository
+	queryIssues(f issueFilter, limit int) ([]*issue, error)
+	countIssues(f issueFilter, groupBy string) ([]*issueCount, error)
+
+	// Uploaded scans, kept apart from repository results. fetchUpload
+	// returns sql.ErrNoRows if there is no such upload.
+	storeUpload(u *upload) error
+	fetchUpload(id string) (*upload, error)
+
+	// Results of private repositories, kept apart from public results.
+	// Only the most recent scan of each path is kept, with Checked set to
+	// the time it was stored.
+	storePrivateResults(s *scan) error
+	fetchPrivateResults(path string) (*scan, error)
+
+	// Garbage collection, see janitor
+	collectGarbage(now time.Time, r retention) (*janitorReport, error)
+}
+
+// A scan records the outcome of analysing a repository once. Every scan is
+// kept, the results for a path point at the most recent one. Results holds
+// the gzip-compressed response document (see buildDocument).
+type scan struct {
+	ID        int64
+	Path      string
+	Timestamp time.Time
+	ETag      string
+	Commit    string
+	RuleSet   string
+	Results   []byte
+	Missing   bool
+
+	// Issues are stored along with the scan by storeResults. They are not
+	// loaded back when fetching scans, use queryIssues for that.
+	Issues []*issue
+
+	// Checked is the last time the repository was checked for changes. It
+	// is only set for the most recent scan of a path (see fetchResults).
+	Checked time.Time
+
+	// Links are put in the results document, they are not stored apart
+	Links *repoLinks
+}
+
+// storedResults returns the results document to write to the database. The
+// results column is not nullable, scans without a document store an empty
+// one.
+func (s *scan) storedResults() []byte {
+	if s.Results == nil {
+		return []byte{}
+	}
+	return s.Results
 }
 
+// sqlDatabase implements database for the SQL backends. Queries are shared,
+// the dialect fills in what differs between databases.
 type sqlDatabase struct {
 	*sql.DB
+	dialect *sqlDialect
+}
+
+// A sqlDialect holds the parts of queries that differ between the SQL
+// backends, and how to migrate them.
+type sqlDialect struct {
+	// placeholder returns the placeholder for the n-th argument
+	placeholder func(n int) string
+
+	// forUpdate is appended to reads of rows that are written later in the
+	// same transaction, to lock them
+	forUpdate string
+
+	// emptyBlob is the literal of an empty blob, for drivers that bind
+	// empty blobs as NULL
+	emptyBlob string
+
+	// upsert returns the clause of an INSERT statement that updates
+	// columns of an existing row with the same key instead
+	upsert func(key string, columns ...string) string
+
+	// ignoreDuplicate is appended to INSERT statements that are allowed
+	// to lose a race to insert the same key
+	ignoreDuplicate string
+
+	// returning is set if inserted IDs are read with a RETURNING clause,
+	// instead of from the result of the statement
+	returning bool
+
+	// migrations is the directory of goose migrations for driver
+	migrations string
+	driver     goose.DBDriver
+}
+
+var mysqlDialect = &sqlDialect{
+	placeholder: questionMark,
+	forUpdate:   " FOR UPDATE",
+	emptyBlob:   "X''",
+	upsert: func(key string, columns ...string) string {
+		set := make([]string, len(columns))
+		for i, c := range columns {
+			set[i] = c + " = VALUES(" + c + ")"
+		}
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	},
+	migrations: "db",
+	driver: goose.DBDriver{
+		Name:    "mysql",
+		Import:  "github.com/go-sql-driver/mysql",
+		Dialect: &goose.MySqlDialect{},
+	},
+}
+
+// upsertExcluded builds an upsert clause for databases that follow the
+// PostgreSQL syntax.
+func upsertExcluded(key string, columns ...string) string {
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = c + " = EXCLUDED." + c
+	}
+	return "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// placeholders returns a list of placeholders for n arguments.
+func (d *sqlDialect) placeholders(n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = d.placeholder(i + 1)
+	}
+	return strings.Join(list, ", ")
 }
 
 type sqlLock struct {
-	db       *sqlDatabase
-	lifetime time.Duration
-	node     string
-	path     string
-	hash     []byte
+	db         *sqlDatabase
+	lifetime   time.Duration
+	node       string
+	path       string
+	hash       []byte
+	generation int64
 }
 
-func newSQLDatabase() (database, error) {
+// newDatabase picks a database backend based on the scheme of the
+// DATABASE_URL environment variable. URLs without a recognized scheme are
+// treated as MySQL DSNs for backwards compatibility.
+func newDatabase() (database, error) {
 	url := os.Getenv("DATABASE_URL")
 	if url == "" {
 		return nil, errors.New("missing DATABASE_URL environment variable")
 	}
 
+	switch {
+	case strings.HasPrefix(url, "memory://"):
+		return newMemoryDatabase(), nil
+	case strings.HasPrefix(url, "postgres://"), strings.HasPrefix(url, "postgresql://"):
+		return newPostgresDatabase(url)
+	case strings.HasPrefix(url, "sqlite://"):
+		return newSQLiteDatabase(strings.TrimPrefix(url, "sqlite://"))
+	case strings.HasPrefix(url, "mysql://"):
+		return newSQLDatabase(strings.TrimPrefix(url, "mysql://"))
+	default:
+		return newSQLDatabase(url)
+	}
+}
+
+func newSQLDatabase(url string) (database, error) {
+	// Report matched instead of changed rows, otherwise refreshing a lock
+	// twice within the same second looks like we lost it.
+	if !strings.Contains(url, "clientFoundRows") {
+		if strings.Contains(url, "?") {
+			url += "&clientFoundRows=true"
+		} else {
+			url += "?clientFoundRows=true"
+		}
+	}
+
 	db, err := sql.Open("mysql", url)
 	if err != nil {
 		return nil, errors.WrapPrefix(err, "unable to talk to DB", 0)
 	}
 
-	return &sqlDatabase{db}, nil
+	return &sqlDatabase{db, mysqlDialect}, nil
+}
+
+// compressLegacyScans converts scans stored before results documents were
+// compressed. It is safe to run on several nodes at the same time. The path
+// of scans migrated from before history was kept is unknown, their ETag is
+// cleared so that the next check replaces them with a full scan.
+func compressLegacyScans(db *sql.DB, placeholder func(n int) string) error {
+	converted := 0
+	for {
+		rows, err := db.Query(
+			`SELECT id, path, timestamp, etag, commit_id, ruleset, results, missing
+			 FROM scans WHERE compressed = `+placeholder(1)+` LIMIT 100`, false)
+		if err != nil {
+			return errors.WrapPrefix(err, "unable to compress results", 0)
+		}
+
+		scans := []*scan{}
+		for rows.Next() {
+			var timestamp int64
+			var etag, commit, ruleset sql.NullString
+			var missing sql.NullBool
+			s := &scan{}
+			err := rows.Scan(&s.ID, &s.Path, &timestamp, &etag, &commit, &ruleset, &s.Results, &missing)
+			if err != nil {
+				rows.Close()
+				return errors.WrapPrefix(err, "unable to compress results", 0)
+			}
+			s.Timestamp = time.Unix(timestamp, 0)
+			s.ETag = etag.String
+			s.Commit = commit.String
+			s.RuleSet = ruleset.String
+			s.Missing = missing.Valid && missing.Bool
+			scans = append(scans, s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return errors.WrapPrefix(err, "unable to compress results", 0)
+		}
+
+		if len(scans) == 0 {
+			break
+		}
+
+		for _, s := range scans {
+			var doc []byte
+			if !s.Missing && len(s.Results) > 0 && json.Valid(s.Results) {
+				doc, err = buildDocument(s.Timestamp, s, json.RawMessage(s.Results))
+				if err != nil {
+					return err
+				}
+			}
+			if s.Path == "" || doc == nil {
+				s.ETag = ""
+			}
+
+			// Not every driver can bind an empty blob, so scans without a
+			// document get an empty literal instead.
+			results := placeholder(1)
+			args := []interface{}{doc}
+			if doc == nil {
+				results = "''"
+				args = nil
+			}
+			args = append(args, s.ETag, true, s.ID, false)
+			n := len(args) - 3
+
+			_, err = db.Exec(
+				`UPDATE scans SET results = `+results+`, etag = `+placeholder(n)+`, compressed = `+placeholder(n+1)+`
+				 WHERE id = `+placeholder(n+2)+` AND compressed = `+placeholder(n+3),
+				args...)
+			if err != nil {
+				return errors.WrapPrefix(err, "unable to compress results", 0)
+			}
+			converted++
+		}
+	}
+
+	if converted > 0 {
+		logger.Printf("compressed %d stored results", converted)
+	}
+	return nil
+}
+
+// nextGeneration increments the global lock generation. The counter row
+// stays locked until tx ends, so generations are handed out in order.
+func nextGeneration(tx *sql.Tx) (int64, error) {
+	_, err := tx.Exec("UPDATE lock_generation SET value = value + 1")
+	if err != nil {
+		return 0, errors.WrapPrefix(err, "unable to increment lock generation", 0)
+	}
+
+	var generation int64
+	err = tx.QueryRow("SELECT value FROM lock_generation").Scan(&generation)
+	if err != nil {
+		return 0, errors.WrapPrefix(err, "unable to read lock generation", 0)
+	}
+	return generation, nil
+}
+
+// checkFence fails with errStaleLock if the path was locked or written
+// under a newer generation than token. The suffix is appended to the
+// queries to lock the rows read, if the database supports it.
+func checkFence(tx *sql.Tx, placeholder func(n int) string, suffix string, hash []byte, token int64) error {
+	for _, table := range []string{"locks", "results"} {
+		var generation int64
+		err := tx.QueryRow(
+			"SELECT generation FROM "+table+" WHERE hash = "+placeholder(1)+suffix, hash).Scan(&generation)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.WrapPrefix(err, "unable to check lock generation", 0)
+		}
+		if err == nil && generation > token {
+			return errStaleLock
+		}
+	}
+	return nil
 }
 
 func (db *sqlDatabase) lockPath(node, path string, lifetime time.Duration) (lock, error) {
+	p := db.dialect.placeholder
 	tx, err := db.Begin()
 	if err != nil {
 		return nil, errors.New(err)
@@ -75,42 +366,70 @@ func (db *sqlDatabase) lockPath(node, path string, lifetime time.Duration) (lock
 	logger.Printf("node %s requesting lock %s for %s", node, path, lifetime.String())
 
 	hash := sha256.Sum256([]byte(path))
-	row := tx.QueryRow("SELECT holder, timestamp, lifetime FROM locks WHERE hash = ?", hash[:])
+	row := tx.QueryRow("SELECT holder, timestamp, lifetime FROM locks WHERE hash = "+p(1)+db.dialect.forUpdate, hash[:])
 
 	var lockHolder string
 	var lockTimestamp int64
 	var lockLifetime int64
 	err = row.Scan(&lockHolder, &lockTimestamp, &lockLifetime)
 	if err != nil && err != sql.ErrNoRows {
+		logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
 		return nil, errors.WrapPrefix(err, "error talking to database", 0)
 	}
 
+	found := err == nil
+	acquire := !found
+	if found {
+		expiry := time.Unix(lockTimestamp, 0).Add(time.Duration(lockLifetime) * time.Second)
+		acquire = lockHolder == node || time.Now().After(expiry)
+	}
+
+	if !acquire {
+		logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
+		logger.Printf("node %s unable to acquire lock %s (already locked)", node, path)
+		return nil, nil
+	}
+
+	generation, err := nextGeneration(tx)
 	if err != nil {
-		// Insert lock
-		_, err := tx.Exec(
-			"INSERT INTO locks (hash, description, holder, timestamp, lifetime) VALUES (?, ?, ?, ?, ?)",
-			hash[:], path, node, time.Now().Unix(), lifetime/time.Second)
+		logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
+		logger.Printf("node %s unable to acquire lock %s (DB error)", node, path)
+		return nil, err
+	}
+
+	if !found {
+		// Insert lock, unless another node beat us to it
+		r, err := tx.Exec(
+			"INSERT INTO locks (hash, description, holder, timestamp, lifetime, generation) VALUES ("+
+				db.dialect.placeholders(6)+")"+db.dialect.ignoreDuplicate,
+			hash[:], path, node, time.Now().Unix(), lifetime/time.Second, generation)
 		if err != nil {
 			logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
 			logger.Printf("node %s unable to acquire lock %s (DB error)", node, path)
 			return nil, errors.WrapPrefix(err, "unable to acquire lock (insert failed)", 0)
 		}
-	} else {
-		expiry := time.Unix(lockTimestamp, 0).Add(time.Duration(lockLifetime) * time.Second)
 
-		if lockHolder == node || time.Now().After(expiry) {
-			_, err := tx.Exec(
-				"UPDATE locks SET holder = ?, timestamp = ?, lifetime = ? WHERE hash = ?",
-				node, time.Now().Unix(), lifetime/time.Second, hash[:])
-			if err != nil {
-				logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
-				logger.Printf("node %s unable to acquire lock %s (DB error)", node, path)
-				return nil, errors.WrapPrefix(err, "unable to acquire lock (update failed)", 0)
-			}
-		} else {
+		n, err := r.RowsAffected()
+		if err != nil {
+			logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
+			logger.Printf("node %s unable to acquire lock %s (result error)", node, path)
+			return nil, errors.WrapPrefix(err, "unable to acquire lock (insert failed)", 0)
+		}
+		if n != 1 {
+			logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
 			logger.Printf("node %s unable to acquire lock %s (already locked)", node, path)
 			return nil, nil
 		}
+	} else {
+		_, err := tx.Exec(
+			"UPDATE locks SET holder = "+p(1)+", timestamp = "+p(2)+", lifetime = "+p(3)+", generation = "+p(4)+
+				" WHERE hash = "+p(5),
+			node, time.Now().Unix(), lifetime/time.Second, generation, hash[:])
+		if err != nil {
+			logError(fmt.Sprintf("node %s error on rollback", node), tx.Rollback())
+			logger.Printf("node %s unable to acquire lock %s (DB error)", node, path)
+			return nil, errors.WrapPrefix(err, "unable to acquire lock (update failed)", 0)
+		}
 	}
 
 	err = tx.Commit()
@@ -118,13 +437,13 @@ func (db *sqlDatabase) lockPath(node, path string, lifetime time.Duration) (lock
 		logger.Printf("node %s unable to acquire lock %s (commit failed)", node, path)
 		return nil, nil
 	}
-	logger.Printf("node %s acquired lock %s for %s", node, path, lifetime.String())
-	return &sqlLock{db, lifetime, node, path, hash[:]}, nil
+	logger.Printf("node %s acquired lock %s for %s (generation %d)", node, path, lifetime.String(), generation)
+	return &sqlLock{db, lifetime, node, path, hash[:], generation}, nil
 }
 
 func (db *sqlDatabase) isLocked(path string) (bool, error) {
 	hash := sha256.Sum256([]byte(path))
-	row := db.QueryRow("SELECT timestamp, lifetime FROM locks WHERE hash = ?", hash[:])
+	row := db.QueryRow("SELECT timestamp, lifetime FROM locks WHERE hash = "+db.dialect.placeholder(1), hash[:])
 
 	var lockTimestamp int64
 	var lockLifetime int64
@@ -148,8 +467,9 @@ func (db *sqlDatabase) isLocked(path string) (bool, error) {
 func (sl *sqlLock) refresh() error {
 	logger.Printf("node %s refreshing lock %s for %s", sl.node, sl.path, sl.lifetime.String())
 
+	p := sl.db.dialect.placeholder
 	r, err := sl.db.Exec(
-		"UPDATE locks SET timestamp = ?, lifetime = ? WHERE hash = ?, holder = ?",
+		"UPDATE locks SET timestamp = "+p(1)+", lifetime = "+p(2)+" WHERE hash = "+p(3)+" AND holder = "+p(4),
 		time.Now().Unix(), sl.lifetime/time.Second, sl.hash, sl.node)
 	if err != nil {
 		logger.Printf("node %s unable to refresh lock %s (DB error)", sl.node, sl.path)
@@ -168,53 +488,292 @@ func (sl *sqlLock) refresh() error {
 	return nil
 }
 
+func (sl *sqlLock) token() int64 {
+	return sl.generation
+}
+
 func (sl *sqlLock) unlock() error {
 	logger.Printf("node %s dropping lock %s", sl.node, sl.path)
 
-	_, err := sl.db.Exec("DELETE FROM locks WHERE hash = ? AND holder = ?", sl.hash, sl.node)
+	p := sl.db.dialect.placeholder
+	_, err := sl.db.Exec("DELETE FROM locks WHERE hash = "+p(1)+" AND holder = "+p(2), sl.hash, sl.node)
 	if err != nil {
 		return errors.WrapPrefix(err, "unable to drop lock", 0)
 	}
 	return nil
 }
 
-func (db *sqlDatabase) storeResults(path, etag, results string, missing bool) error {
-	hash := sha256.Sum256([]byte(path))
-	_, err := db.Exec(
-		`INSERT INTO results (hash, timestamp, etag, results, missing) VALUES (?, ?, ?, ?, ?) 
-		 ON DUPLICATE KEY UPDATE timestamp = ?, etag = ?, results = ?, missing = ?`,
-		hash[:], time.Now().Unix(), etag, results, missing, time.Now().Unix(), etag, results, missing)
+// insertID runs an INSERT statement and returns the ID of the new row.
+func (db *sqlDatabase) insertID(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	var id int64
+	if db.dialect.returning {
+		err := tx.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	r, err := tx.Exec(query, args...)
+	if err == nil {
+		id, err = r.LastInsertId()
+	}
+	return id, err
+}
+
+func (db *sqlDatabase) storeResults(s *scan, token int64) error {
+	d := db.dialect
+	hash := sha256.Sum256([]byte(s.Path))
+	now := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+
+	if err := checkFence(tx, d.placeholder, d.forUpdate, hash[:], token); err != nil {
+		logError("error on rollback", tx.Rollback())
+		return err
+	}
+
+	id, err := db.insertID(tx,
+		`INSERT INTO scans (hash, path, timestamp, etag, commit_id, ruleset, results, missing, compressed)
+		 VALUES (`+d.placeholders(6)+`, COALESCE(`+d.placeholder(7)+`, `+d.emptyBlob+`), `+
+			d.placeholder(8)+`, `+d.placeholder(9)+`)`,
+		hash[:], s.Path, now.Unix(), s.ETag, s.Commit, s.RuleSet, s.storedResults(), s.Missing, true)
+	if err != nil {
+		logError("error on rollback", tx.Rollback())
+		return errors.WrapPrefix(err, "unable to store scan", 0)
+	}
+
+	for _, i := range s.Issues {
+		_, err = tx.Exec(
+			`INSERT INTO issues (scan_id, repo, rule, file, line, severity, confidence, details, snippet)
+			 VALUES (`+d.placeholders(9)+`)`,
+			id, s.Path, i.Rule, i.File, i.Line, i.Severity, i.Confidence, i.Details, i.Snippet)
+		if err != nil {
+			logError("error on rollback", tx.Rollback())
+			return errors.WrapPrefix(err, "unable to store issues", 0)
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO results (hash, timestamp, scan_id, generation) VALUES (`+d.placeholders(4)+`) `+
+			d.upsert("hash", "timestamp", "scan_id", "generation"),
+		hash[:], now.Unix(), id, token)
 	if err != nil {
+		logError("error on rollback", tx.Rollback())
+		return errors.WrapPrefix(err, "unable to store results", 0)
+	}
+
+	if err = tx.Commit(); err != nil {
 		return errors.New(err)
 	}
+
+	s.ID = id
+	s.Timestamp = time.Unix(now.Unix(), 0)
+	s.Checked = s.Timestamp
 	return nil
 }
 
-func (db *sqlDatabase) fetchResults(path string) (time.Time, string, string, bool, error) {
+func (db *sqlDatabase) fetchResults(path string) (*scan, error) {
 	hash := sha256.Sum256([]byte(path))
-	r := db.QueryRow("SELECT timestamp, etag, results, missing FROM results WHERE hash = ?", hash[:])
+	r := db.QueryRow(
+		`SELECT r.timestamp, s.id, s.timestamp, s.etag, s.commit_id, s.ruleset, s.results, s.missing
+		 FROM results r JOIN scans s ON s.id = r.scan_id WHERE r.hash = `+db.dialect.placeholder(1), hash[:])
 
-	var timestamp int64
-	var results string
-	var etag sql.NullString
+	var checked, timestamp int64
+	var etag, commit, ruleset sql.NullString
 	var missing sql.NullBool
-	err := r.Scan(&timestamp, &etag, &results, &missing)
+	s := &scan{Path: path}
+	err := r.Scan(&checked, &s.ID, &timestamp, &etag, &commit, &ruleset, &s.Results, &missing)
 	if err == sql.ErrNoRows {
-		return time.Now(), "", "", false, err
+		return nil, err
 	} else if err != nil {
-		return time.Now(), "", "", false, errors.New(err)
+		return nil, errors.New(err)
 	}
 
-	return time.Unix(timestamp, 0), etag.String, results, missing.Valid && missing.Bool, nil
+	s.Timestamp = time.Unix(timestamp, 0)
+	s.Checked = time.Unix(checked, 0)
+	s.ETag = etag.String
+	s.Commit = commit.String
+	s.RuleSet = ruleset.String
+	s.Missing = missing.Valid && missing.Bool
+	return s, nil
 }
 
-func (db *sqlDatabase) updateTimestamp(path string) error {
+func (db *sqlDatabase) updateTimestamp(path string, token int64) error {
+	p := db.dialect.placeholder
 	hash := sha256.Sum256([]byte(path))
-	_, err := db.Exec(
-		`UPDATE results SET timestamp = ? WHERE hash = ?`,
-		time.Now().Unix(), hash[:])
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+
+	if err := checkFence(tx, p, db.dialect.forUpdate, hash[:], token); err != nil {
+		logError("error on rollback", tx.Rollback())
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE results SET timestamp = `+p(1)+`, generation = `+p(2)+` WHERE hash = `+p(3),
+		time.Now().Unix(), token, hash[:])
 	if err != nil {
+		logError("error on rollback", tx.Rollback())
+		return errors.New(err)
+	}
+
+	if err = tx.Commit(); err != nil {
 		return errors.New(err)
 	}
 	return nil
 }
+
+func (db *sqlDatabase) listScans(path string, limit int) ([]*scan, error) {
+	p := db.dialect.placeholder
+	hash := sha256.Sum256([]byte(path))
+	rows, err := db.Query(
+		`SELECT id, timestamp, etag, commit_id, ruleset, missing FROM scans
+		 WHERE hash = `+p(1)+` ORDER BY id DESC LIMIT `+p(2), hash[:], limit)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to list scans", 0)
+	}
+	defer rows.Close()
+
+	scans := []*scan{}
+	for rows.Next() {
+		var timestamp int64
+		var etag, commit, ruleset sql.NullString
+		var missing sql.NullBool
+		s := &scan{Path: path}
+		if err := rows.Scan(&s.ID, &timestamp, &etag, &commit, &ruleset, &missing); err != nil {
+			return nil, errors.WrapPrefix(err, "unable to list scans", 0)
+		}
+		s.Timestamp = time.Unix(timestamp, 0)
+		s.ETag = etag.String
+		s.Commit = commit.String
+		s.RuleSet = ruleset.String
+		s.Missing = missing.Valid && missing.Bool
+		scans = append(scans, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to list scans", 0)
+	}
+	return scans, nil
+}
+
+func (db *sqlDatabase) fetchScan(path string, id int64) (*scan, error) {
+	p := db.dialect.placeholder
+	hash := sha256.Sum256([]byte(path))
+	r := db.QueryRow(
+		`SELECT timestamp, etag, commit_id, ruleset, results, missing FROM scans
+		 WHERE id = `+p(1)+` AND hash = `+p(2), id, hash[:])
+
+	var timestamp int64
+	var etag, commit, ruleset sql.NullString
+	var missing sql.NullBool
+	s := &scan{ID: id, Path: path}
+	err := r.Scan(&timestamp, &etag, &commit, &ruleset, &s.Results, &missing)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	s.Timestamp = time.Unix(timestamp, 0)
+	s.ETag = etag.String
+	s.Commit = commit.String
+	s.RuleSet = ruleset.String
+	s.Missing = missing.Valid && missing.Bool
+	return s, nil
+}
+
+func (db *sqlDatabase) findScanByCommit(commit, ruleSet string) (*scan, error) {
+	p := db.dialect.placeholder
+	r := db.QueryRow(
+		`SELECT id, path, timestamp, etag, results FROM scans
+		 WHERE commit_id = `+p(1)+` AND ruleset = `+p(2)+` AND missing = `+p(3)+` AND path <> ''
+		 ORDER BY id DESC LIMIT 1`, commit, ruleSet, false)
+
+	var timestamp int64
+	var etag sql.NullString
+	s := &scan{Commit: commit, RuleSet: ruleSet}
+	err := r.Scan(&s.ID, &s.Path, &timestamp, &etag, &s.Results)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	s.Timestamp = time.Unix(timestamp, 0)
+	s.ETag = etag.String
+
+	rows, err := db.Query(
+		`SELECT scan_id, repo, rule, file, line, severity, confidence, details, snippet
+		 FROM issues WHERE scan_id = `+p(1)+` ORDER BY id`, s.ID)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to fetch issues", 0)
+	}
+	s.Issues, err = scanIssues(rows)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to fetch issues", 0)
+	}
+	return s, nil
+}
+
+func (db *sqlDatabase) queryIssues(f issueFilter, limit int) ([]*issue, error) {
+	where, args := f.where(db.dialect.placeholder)
+	rows, err := db.Query(
+		`SELECT i.scan_id, i.repo, i.rule, i.file, i.line, i.severity, i.confidence, i.details, i.snippet
+		 FROM issues i JOIN results r ON r.scan_id = i.scan_id
+		 WHERE `+where+` ORDER BY i.repo, i.file, i.line LIMIT `+db.dialect.placeholder(len(args)+1),
+		append(args, limit)...)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to query issues", 0)
+	}
+
+	issues, err := scanIssues(rows)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to query issues", 0)
+	}
+	return issues, nil
+}
+
+func (db *sqlDatabase) countIssues(f issueFilter, groupBy string) ([]*issueCount, error) {
+	column, ok := issueGroups[groupBy]
+	if !ok {
+		return nil, errors.Errorf("unable to count issues: invalid grouping %s", groupBy)
+	}
+
+	where, args := f.where(db.dialect.placeholder)
+	rows, err := db.Query(
+		`SELECT i.`+column+`, COUNT(*) FROM issues i JOIN results r ON r.scan_id = i.scan_id
+		 WHERE `+where+` GROUP BY i.`+column+` ORDER BY COUNT(*) DESC, i.`+column,
+		args...)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to count issues", 0)
+	}
+
+	counts, err := scanIssueCounts(rows)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to count issues", 0)
+	}
+	return counts, nil
+}
+
+func (db *sqlDatabase) storeUpload(u *upload) error {
+	return insertUpload(db.DB, db.dialect.placeholder, u)
+}
+
+func (db *sqlDatabase) fetchUpload(id string) (*upload, error) {
+	return selectUpload(db.DB, db.dialect.placeholder, id)
+}
+
+func (db *sqlDatabase) storePrivateResults(s *scan) error {
+	return replacePrivateResults(db.DB, db.dialect.placeholder, s)
+}
+
+func (db *sqlDatabase) fetchPrivateResults(path string) (*scan, error) {
+	return selectPrivateResults(db.DB, db.dialect.placeholder, path)
+}
+
+func (db *sqlDatabase) collectGarbage(now time.Time, r retention) (*janitorReport, error) {
+	return deleteGarbage(db.DB, db.dialect.placeholder, now, r)
+}
@@ -0,0 +1,616 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// The conformance suite runs against every backend. The in-memory and
+// SQLite backends always run, MySQL and PostgreSQL only run if a test
+// database is configured via TEST_MYSQL_URL or TEST_POSTGRES_URL.
+
+func TestMemoryDatabase(t *testing.T) {
+	testDatabase(t, newMemoryDatabase())
+}
+
+func TestSQLiteDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := newSQLiteDatabase(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(db)
+
+	testDatabase(t, db)
+}
+
+func TestMySQLDatabase(t *testing.T) {
+	url := os.Getenv("TEST_MYSQL_URL")
+	if url == "" {
+		t.Skip("TEST_MYSQL_URL not set")
+	}
+
+	db, err := newSQLDatabase(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(db)
+
+	testDatabase(t, db)
+}
+
+func TestPostgresDatabase(t *testing.T) {
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL not set")
+	}
+
+	db, err := newPostgresDatabase(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(db)
+
+	testDatabase(t, db)
+}
+
+func testPath() string {
+	return fmt.Sprintf("github.com/gas-web-test/%s", uuid.NewV4().String())
+}
+
+func testDatabase(t *testing.T, db database) {
+	t.Run("LockAcquire", func(t *testing.T) { testLockAcquire(t, db) })
+	t.Run("LockExpiry", func(t *testing.T) { testLockExpiry(t, db) })
+	t.Run("LockRefresh", func(t *testing.T) { testLockRefresh(t, db) })
+	t.Run("LockUnlock", func(t *testing.T) { testLockUnlock(t, db) })
+	t.Run("LockFencing", func(t *testing.T) { testLockFencing(t, db) })
+	t.Run("Results", func(t *testing.T) { testResults(t, db) })
+	t.Run("History", func(t *testing.T) { testHistory(t, db) })
+	t.Run("Issues", func(t *testing.T) { testIssues(t, db) })
+	t.Run("CommitLookup", func(t *testing.T) { testCommitLookup(t, db) })
+	t.Run("Uploads", func(t *testing.T) { testUploads(t, db) })
+	t.Run("PrivateResults", func(t *testing.T) { testPrivateResults(t, db) })
+
+	// Must run last, it drops the data of the other tests
+	t.Run("Janitor", func(t *testing.T) { testJanitor(t, db) })
+}
+
+func testLockAcquire(t *testing.T, db database) {
+	path := testPath()
+
+	locked, err := db.isLocked(path)
+	if err != nil || locked {
+		t.Fatalf("expected unlocked path, got %v (%v)", locked, err)
+	}
+
+	l, err := db.lockPath("node-a", path, time.Minute)
+	if err != nil || l == nil {
+		t.Fatalf("unable to acquire free lock: %v", err)
+	}
+
+	locked, err = db.isLocked(path)
+	if err != nil || !locked {
+		t.Fatalf("expected locked path, got %v (%v)", locked, err)
+	}
+
+	// Held by someone else
+	other, err := db.lockPath("node-b", path, time.Minute)
+	if err != nil || other != nil {
+		t.Fatalf("acquired lock held by another node: %v", err)
+	}
+
+	// Re-acquiring our own lock is allowed
+	again, err := db.lockPath("node-a", path, time.Minute)
+	if err != nil || again == nil {
+		t.Fatalf("unable to re-acquire own lock: %v", err)
+	}
+
+	// Other paths are unaffected
+	unrelated, err := db.lockPath("node-b", testPath(), time.Minute)
+	if err != nil || unrelated == nil {
+		t.Fatalf("unable to acquire unrelated lock: %v", err)
+	}
+}
+
+func testLockExpiry(t *testing.T, db database) {
+	path := testPath()
+
+	a, err := db.lockPath("node-a", path, 1*time.Second)
+	if err != nil || a == nil {
+		t.Fatalf("unable to acquire free lock: %v", err)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	locked, err := db.isLocked(path)
+	if err != nil || locked {
+		t.Fatalf("expected expired lock, got %v (%v)", locked, err)
+	}
+
+	// Expired locks can be stolen
+	b, err := db.lockPath("node-b", path, time.Minute)
+	if err != nil || b == nil {
+		t.Fatalf("unable to steal expired lock: %v", err)
+	}
+
+	// The previous holder must notice it lost the lock
+	if err := a.refresh(); err == nil {
+		t.Fatal("refreshed a stolen lock")
+	}
+
+	// Unlocking a stolen lock must not release the new holder's lock
+	if err := a.unlock(); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	locked, err = db.isLocked(path)
+	if err != nil || !locked {
+		t.Fatalf("previous holder released stolen lock, got %v (%v)", locked, err)
+	}
+}
+
+func testLockRefresh(t *testing.T, db database) {
+	path := testPath()
+
+	l, err := db.lockPath("node-a", path, 1*time.Second)
+	if err != nil || l == nil {
+		t.Fatalf("unable to acquire free lock: %v", err)
+	}
+
+	// Refresh twice in quick succession, neither must look like a lost lock
+	if err := l.refresh(); err != nil {
+		t.Fatalf("unable to refresh lock: %v", err)
+	}
+	if err := l.refresh(); err != nil {
+		t.Fatalf("unable to refresh lock: %v", err)
+	}
+
+	// Without another refresh the lock would have expired by now
+	time.Sleep(1500 * time.Millisecond)
+	if err := l.refresh(); err != nil {
+		t.Fatalf("unable to refresh lock: %v", err)
+	}
+
+	locked, err := db.isLocked(path)
+	if err != nil || !locked {
+		t.Fatalf("expected refreshed lock, got %v (%v)", locked, err)
+	}
+}
+
+func testLockUnlock(t *testing.T, db database) {
+	path := testPath()
+
+	l, err := db.lockPath("node-a", path, time.Minute)
+	if err != nil || l == nil {
+		t.Fatalf("unable to acquire free lock: %v", err)
+	}
+
+	if err := l.unlock(); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+
+	locked, err := db.isLocked(path)
+	if err != nil || locked {
+		t.Fatalf("expected unlocked path, got %v (%v)", locked, err)
+	}
+
+	if err := l.refresh(); err == nil {
+		t.Fatal("refreshed a dropped lock")
+	}
+
+	other, err := db.lockPath("node-b", path, time.Minute)
+	if err != nil || other == nil {
+		t.Fatalf("unable to acquire dropped lock: %v", err)
+	}
+}
+
+func testLockFencing(t *testing.T, db database) {
+	path := testPath()
+
+	stale, err := db.lockPath("node-a", path, time.Minute)
+	if err != nil || stale == nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+	if err := stale.unlock(); err != nil {
+		t.Fatalf("unable to drop lock: %v", err)
+	}
+
+	current, err := db.lockPath("node-b", path, time.Minute)
+	if err != nil || current == nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+	if current.token() <= stale.token() {
+		t.Fatalf("expected increasing lock generations, got %d after %d", current.token(), stale.token())
+	}
+
+	// The stale holder is fenced off while the new one holds the lock...
+	if err := db.storeResults(&scan{Path: path, ETag: "a"}, stale.token()); err != errStaleLock {
+		t.Fatalf("expected errStaleLock, got %v", err)
+	}
+	if err := db.storeResults(&scan{Path: path, ETag: "b"}, current.token()); err != nil {
+		t.Fatalf("unable to store results: %v", err)
+	}
+	if err := current.unlock(); err != nil {
+		t.Fatalf("unable to drop lock: %v", err)
+	}
+
+	// ...and after it wrote newer results
+	if err := db.storeResults(&scan{Path: path, ETag: "a"}, stale.token()); err != errStaleLock {
+		t.Fatalf("expected errStaleLock, got %v", err)
+	}
+	if err := db.updateTimestamp(path, stale.token()); err != errStaleLock {
+		t.Fatalf("expected errStaleLock, got %v", err)
+	}
+	s, err := db.fetchResults(path)
+	if err != nil || s.ETag != "b" {
+		t.Fatalf("expected results of the current holder, got %+v (%v)", s, err)
+	}
+
+	next, err := db.lockPath("node-a", path, time.Minute)
+	if err != nil || next == nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+	defer next.unlock()
+	if err := db.updateTimestamp(path, next.token()); err != nil {
+		t.Fatalf("unable to update timestamp: %v", err)
+	}
+}
+
+func testResults(t *testing.T, db database) {
+	path := testPath()
+
+	_, err := db.fetchResults(path)
+	if err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for unknown path, got %v", err)
+	}
+
+	first := &scan{Path: path, ETag: `"v1"`, Commit: "abc", RuleSet: "r1", Results: []byte(`{"issues":[]}`)}
+	if err := db.storeResults(first, 0); err != nil {
+		t.Fatalf("unable to store results: %v", err)
+	}
+	if first.ID == 0 {
+		t.Fatal("stored scan has no ID")
+	}
+
+	s1, err := db.fetchResults(path)
+	if err != nil {
+		t.Fatalf("unable to fetch results: %v", err)
+	}
+	if s1.ETag != `"v1"` || s1.Commit != "abc" || s1.RuleSet != "r1" || string(s1.Results) != `{"issues":[]}` || s1.Missing {
+		t.Fatalf("unexpected results: %+v", s1)
+	}
+	if time.Since(s1.Checked) > time.Minute || time.Since(s1.Timestamp) > time.Minute {
+		t.Fatalf("unexpected timestamps %v, %v", s1.Checked, s1.Timestamp)
+	}
+
+	// Storing again replaces the latest results
+	if err := db.storeResults(&scan{Path: path, ETag: `"v2"`, Results: []byte(`{"issues":[{}]}`)}, 0); err != nil {
+		t.Fatalf("unable to store results: %v", err)
+	}
+	s2, err := db.fetchResults(path)
+	if err != nil {
+		t.Fatalf("unable to fetch results: %v", err)
+	}
+	if s2.ETag != `"v2"` || string(s2.Results) != `{"issues":[{}]}` || s2.Missing || s2.ID == s1.ID {
+		t.Fatalf("unexpected results after upsert: %+v", s2)
+	}
+
+	// Repositories can disappear
+	if err := db.storeResults(&scan{Path: path, Missing: true}, 0); err != nil {
+		t.Fatalf("unable to store results: %v", err)
+	}
+	s3, err := db.fetchResults(path)
+	if err != nil || !s3.Missing {
+		t.Fatalf("expected missing repository, got %+v (%v)", s3, err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := db.updateTimestamp(path, 0); err != nil {
+		t.Fatalf("unable to update timestamp: %v", err)
+	}
+	s4, err := db.fetchResults(path)
+	if err != nil {
+		t.Fatalf("unable to fetch results: %v", err)
+	}
+	if !s4.Checked.After(s3.Checked) || !s4.Timestamp.Equal(s3.Timestamp) {
+		t.Fatalf("timestamp not updated: %+v vs %+v", s4, s3)
+	}
+
+	// Updating the timestamp of unknown paths is a no-op
+	if err := db.updateTimestamp(testPath(), 0); err != nil {
+		t.Fatalf("unable to update timestamp: %v", err)
+	}
+}
+
+func testHistory(t *testing.T, db database) {
+	path := testPath()
+
+	for _, etag := range []string{"a", "b", "c"} {
+		s := &scan{Path: path, ETag: etag, Results: []byte(`{"etag":"` + etag + `"}`)}
+		if err := db.storeResults(s, 0); err != nil {
+			t.Fatalf("unable to store results: %v", err)
+		}
+	}
+
+	// Other paths must not show up in the history
+	if err := db.storeResults(&scan{Path: testPath(), Results: []byte("{}")}, 0); err != nil {
+		t.Fatalf("unable to store results: %v", err)
+	}
+
+	scans, err := db.listScans(path, 10)
+	if err != nil {
+		t.Fatalf("unable to list scans: %v", err)
+	}
+	if len(scans) != 3 || scans[0].ETag != "c" || scans[2].ETag != "a" {
+		t.Fatalf("unexpected history: %+v", scans)
+	}
+
+	limited, err := db.listScans(path, 2)
+	if err != nil || len(limited) != 2 {
+		t.Fatalf("expected two scans, got %d (%v)", len(limited), err)
+	}
+
+	s, err := db.fetchScan(path, scans[2].ID)
+	if err != nil {
+		t.Fatalf("unable to fetch scan: %v", err)
+	}
+	if s.ETag != "a" || string(s.Results) != `{"etag":"a"}` {
+		t.Fatalf("unexpected scan: %+v", s)
+	}
+
+	// Scans are only visible under their own path
+	if _, err := db.fetchScan(testPath(), scans[2].ID); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for foreign scan, got %v", err)
+	}
+}
+
+func testIssues(t *testing.T, db database) {
+	// Rules are shared by every backend run, so use a unique rule ID
+	rule := "T" + uuid.NewV4().String()[:8]
+	a, b := testPath(), testPath()
+
+	stale := &scan{Path: a, Results: []byte("{}"), Issues: []*issue{
+		{Rule: rule, File: "old.go", Line: 1, Severity: "HIGH", Confidence: "HIGH"},
+	}}
+	current := &scan{Path: a, Results: []byte("{}"), Issues: []*issue{
+		{Rule: rule, File: "a.go", Line: 10, Severity: "HIGH", Confidence: "LOW", Details: "details", Snippet: "code"},
+		{Rule: rule, File: "a.go", Line: 2, Severity: "MEDIUM", Confidence: "LOW"},
+		{Rule: "G000", File: "b.go", Line: 3, Severity: "HIGH", Confidence: "LOW"},
+	}}
+	other := &scan{Path: b, Results: []byte("{}"), Issues: []*issue{
+		{Rule: rule, File: "c.go", Line: 4, Severity: "HIGH", Confidence: "HIGH"},
+	}}
+	for _, s := range []*scan{stale, current, other} {
+		if err := db.storeResults(s, 0); err != nil {
+			t.Fatalf("unable to store results: %v", err)
+		}
+	}
+
+	issues, err := db.queryIssues(issueFilter{Rule: rule}, 10)
+	if err != nil {
+		t.Fatalf("unable to query issues: %v", err)
+	}
+	if len(issues) != 3 {
+		t.Fatalf("expected 3 current issues, got %d", len(issues))
+	}
+	for _, i := range issues {
+		if i.File == "old.go" {
+			t.Fatal("issue from superseded scan returned")
+		}
+	}
+
+	issues, err = db.queryIssues(issueFilter{Repo: a, Rule: rule, Severity: "HIGH"}, 10)
+	if err != nil {
+		t.Fatalf("unable to query issues: %v", err)
+	}
+	if len(issues) != 1 {
+		t.Fatalf("expected 1 matching issue, got %d", len(issues))
+	}
+	i := issues[0]
+	if i.ScanID != current.ID || i.Repo != a || i.File != "a.go" || i.Line != 10 ||
+		i.Confidence != "LOW" || i.Details != "details" || i.Snippet != "code" {
+		t.Fatalf("unexpected issue: %+v", i)
+	}
+
+	limited, err := db.queryIssues(issueFilter{Rule: rule}, 1)
+	if err != nil || len(limited) != 1 {
+		t.Fatalf("expected 1 issue, got %d (%v)", len(limited), err)
+	}
+
+	counts, err := db.countIssues(issueFilter{Rule: rule}, "repo")
+	if err != nil {
+		t.Fatalf("unable to count issues: %v", err)
+	}
+	if len(counts) != 2 || counts[0].Key != a || counts[0].Count != 2 || counts[1].Key != b || counts[1].Count != 1 {
+		t.Fatalf("unexpected counts: %+v, %+v", counts[0], counts[len(counts)-1])
+	}
+
+	if _, err := db.countIssues(issueFilter{}, "snippet; DROP TABLE issues"); err == nil {
+		t.Fatal("counted issues by invalid grouping")
+	}
+}
+
+func testCommitLookup(t *testing.T, db database) {
+	// Commits are shared by every backend run, so use a unique commit ID
+	commit := strings.Replace(uuid.NewV4().String(), "-", "", -1) + "01234567"
+	a, b := testPath(), testPath()
+
+	if _, err := db.findScanByCommit(commit, "r1"); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for unknown commit, got %v", err)
+	}
+
+	analysed := &scan{Path: a, ETag: "a", Commit: commit, RuleSet: "r1", Results: []byte("{}"), Issues: []*issue{
+		{Rule: "G101", File: "a.go", Line: 1, Severity: "HIGH", Confidence: "LOW", Details: "details", Snippet: "code"},
+		{Rule: "G102", File: "b.go", Line: 2, Severity: "MEDIUM", Confidence: "HIGH"},
+	}}
+	missing := &scan{Path: b, Commit: commit, RuleSet: "r1", Missing: true}
+	for _, s := range []*scan{analysed, missing} {
+		if err := db.storeResults(s, 0); err != nil {
+			t.Fatalf("unable to store results: %v", err)
+		}
+	}
+
+	s, err := db.findScanByCommit(commit, "r1")
+	if err != nil {
+		t.Fatalf("unable to find scan by commit: %v", err)
+	}
+	if s.ID != analysed.ID || s.Path != a || string(s.Results) != "{}" || len(s.Issues) != 2 {
+		t.Fatalf("unexpected scan %+v", s)
+	}
+	if i := s.Issues[0]; i.Rule != "G101" || i.Repo != a || i.Details != "details" || i.Snippet != "code" {
+		t.Fatalf("unexpected issue %+v", i)
+	}
+
+	// Results of other rule sets can't be reused
+	if _, err := db.findScanByCommit(commit, "r2"); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for other rule set, got %v", err)
+	}
+}
+
+func testUploads(t *testing.T, db database) {
+	id, _ := randomHex(16)
+	u := &upload{
+		ID:        id,
+		TokenHash: hashToken("secret"),
+		Timestamp: time.Unix(time.Now().Unix(), 0),
+		RuleSet:   "rules",
+		Results:   []byte("document"),
+	}
+	if err := db.storeUpload(u); err != nil {
+		t.Fatalf("unable to store upload: %v", err)
+	}
+	if err := db.storeUpload(u); err == nil {
+		t.Fatal("expected duplicate upload to be rejected")
+	}
+
+	found, err := db.fetchUpload(id)
+	if err != nil {
+		t.Fatalf("unable to fetch upload: %v", err)
+	}
+	if !bytes.Equal(found.TokenHash, u.TokenHash) || !found.Timestamp.Equal(u.Timestamp) ||
+		found.RuleSet != u.RuleSet || string(found.Results) != "document" {
+		t.Fatalf("unexpected upload %+v", found)
+	}
+
+	if _, err := db.fetchUpload("missing"); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testPrivateResults(t *testing.T, db database) {
+	path := testPath()
+
+	if _, err := db.fetchPrivateResults(path); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+
+	for _, etag := range []string{"v1", "v2"} {
+		s := &scan{Path: path, ETag: etag, Commit: "abc", RuleSet: "rules", Results: []byte("doc " + etag)}
+		if err := db.storePrivateResults(s); err != nil {
+			t.Fatalf("unable to store private results: %v", err)
+		}
+		if s.Checked.IsZero() {
+			t.Fatal("expected checked time to be set")
+		}
+	}
+
+	s, err := db.fetchPrivateResults(path)
+	if err != nil {
+		t.Fatalf("unable to fetch private results: %v", err)
+	}
+	if s.ETag != "v2" || s.Commit != "abc" || s.RuleSet != "rules" || string(s.Results) != "doc v2" || s.Checked.IsZero() {
+		t.Fatalf("unexpected private results %+v", s)
+	}
+
+	// Private results never show up as public results or in the history
+	if _, err := db.fetchResults(path); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for public results, got %v", err)
+	}
+	if scans, err := db.listScans(path, 10); err != nil || len(scans) != 0 {
+		t.Fatalf("expected no history, got %d (%v)", len(scans), err)
+	}
+}
+
+func testJanitor(t *testing.T, db database) {
+	locked, a := testPath(), testPath()
+
+	if _, err := db.lockPath("node-a", locked, time.Minute); err != nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+	for _, name := range []string{"old.go", "new.go"} {
+		s := &scan{Path: a, Results: []byte("{}"), Issues: []*issue{{Rule: "G000", File: name}}}
+		if err := db.storeResults(s, 0); err != nil {
+			t.Fatalf("unable to store results: %v", err)
+		}
+	}
+
+	// Nothing is old enough yet, apart from locks left by other tests
+	report, err := db.collectGarbage(time.Now(), retention{Results: time.Hour, History: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to collect garbage: %v", err)
+	}
+	if report.Results != 0 || report.Scans != 0 || report.Issues != 0 || report.Uploads != 0 || report.Private != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// Expired locks and superseded scans go first
+	report, err = db.collectGarbage(time.Now().Add(2*time.Hour), retention{History: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to collect garbage: %v", err)
+	}
+	if report.Locks < 1 || report.Scans < 1 || report.Issues < 1 || report.Results != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if l, err := db.isLocked(locked); err != nil || l {
+		t.Fatalf("expected expired lock to be removed (%v)", err)
+	}
+	scans, err := db.listScans(a, 10)
+	if err != nil || len(scans) != 1 {
+		t.Fatalf("expected only the latest scan to remain, got %d (%v)", len(scans), err)
+	}
+	issues, err := db.queryIssues(issueFilter{Repo: a}, 10)
+	if err != nil || len(issues) != 1 || issues[0].File != "new.go" {
+		t.Fatalf("expected only the latest issues to remain, got %+v (%v)", issues, err)
+	}
+
+	// Then repositories nobody checked for too long
+	report, err = db.collectGarbage(time.Now().Add(2*time.Hour), retention{Results: time.Hour})
+	if err != nil {
+		t.Fatalf("unable to collect garbage: %v", err)
+	}
+	if report.Results < 1 || report.Scans < 1 || report.Issues < 1 || report.Uploads < 1 || report.Private < 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := db.fetchResults(a); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows for expired results, got %v", err)
+	}
+	if scans, err := db.listScans(a, 10); err != nil || len(scans) != 0 {
+		t.Fatalf("expected history to be removed, got %d (%v)", len(scans), err)
+	}
+}
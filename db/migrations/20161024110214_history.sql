@@ -0,0 +1,30 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE scans (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  hash BINARY(32) NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  timestamp BIGINT NOT NULL,
+  etag VARCHAR(255),
+  commit_id VARCHAR(64),
+  ruleset VARCHAR(64),
+  results MEDIUMTEXT NOT NULL,
+  missing BOOLEAN,
+  INDEX scans_hash (hash)
+) ENGINE=InnoDB, CHARACTER SET=utf8, COLLATE=utf8_unicode_ci;
+
+-- Existing results become the first scan in each history. Their path was
+-- never recorded, so it is left empty.
+INSERT INTO scans (hash, path, timestamp, etag, results, missing)
+  SELECT hash, '', timestamp, etag, COALESCE(results, ''), missing FROM results;
+
+ALTER TABLE results ADD COLUMN scan_id BIGINT;
+UPDATE results r JOIN scans s ON s.hash = r.hash SET r.scan_id = s.id;
+ALTER TABLE results DROP COLUMN etag, DROP COLUMN results, DROP COLUMN missing;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+ALTER TABLE results ADD COLUMN etag VARCHAR(255), ADD COLUMN results MEDIUMTEXT, ADD COLUMN missing BOOLEAN;
+UPDATE results r JOIN scans s ON s.id = r.scan_id SET r.etag = s.etag, r.results = s.results, r.missing = s.missing;
+ALTER TABLE results DROP COLUMN scan_id;
+DROP TABLE IF EXISTS scans;
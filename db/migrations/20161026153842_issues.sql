@@ -0,0 +1,21 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE issues (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  scan_id BIGINT NOT NULL,
+  repo VARCHAR(255) NOT NULL,
+  rule VARCHAR(16) NOT NULL,
+  file VARCHAR(1024) NOT NULL,
+  line INT NOT NULL,
+  severity VARCHAR(16) NOT NULL,
+  confidence VARCHAR(16) NOT NULL,
+  details TEXT NOT NULL,
+  snippet TEXT NOT NULL,
+  INDEX issues_scan (scan_id),
+  INDEX issues_repo (repo),
+  INDEX issues_rule (rule)
+) ENGINE=InnoDB, CHARACTER SET=utf8, COLLATE=utf8_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS issues;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE INDEX scans_timestamp ON scans (timestamp);
+CREATE INDEX results_timestamp ON results (timestamp);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP INDEX results_timestamp ON results;
+DROP INDEX scans_timestamp ON scans;
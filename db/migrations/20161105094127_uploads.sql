@@ -0,0 +1,14 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE uploads (
+  id VARCHAR(64) PRIMARY KEY,
+  token_hash VARBINARY(32) NOT NULL,
+  timestamp BIGINT NOT NULL,
+  ruleset VARCHAR(64) NOT NULL,
+  results MEDIUMBLOB NOT NULL,
+  INDEX uploads_timestamp (timestamp)
+) ENGINE=InnoDB, CHARACTER SET=utf8, COLLATE=utf8_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS uploads;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE private_results (
+  hash VARBINARY(32) PRIMARY KEY,
+  path VARCHAR(255) NOT NULL,
+  timestamp BIGINT NOT NULL,
+  etag VARCHAR(255) NOT NULL,
+  commit_id VARCHAR(64) NOT NULL,
+  ruleset VARCHAR(64) NOT NULL,
+  results MEDIUMBLOB NOT NULL,
+  INDEX private_results_timestamp (timestamp)
+) ENGINE=InnoDB, CHARACTER SET=utf8, COLLATE=utf8_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS private_results;
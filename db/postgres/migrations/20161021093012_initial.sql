@@ -0,0 +1,24 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE locks (
+  id BIGSERIAL PRIMARY KEY,
+  hash BYTEA UNIQUE NOT NULL,
+  description VARCHAR(255) NOT NULL,
+  holder VARCHAR(255) NOT NULL,
+  timestamp BIGINT NOT NULL,
+  lifetime BIGINT NOT NULL
+);
+
+CREATE TABLE results (
+  id BIGSERIAL PRIMARY KEY,
+  hash BYTEA UNIQUE NOT NULL,
+  timestamp BIGINT NOT NULL,
+  etag VARCHAR(255),
+  results TEXT NOT NULL,
+  missing BOOLEAN
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS locks;
+DROP TABLE IF EXISTS results;
@@ -0,0 +1,30 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE scans (
+  id BIGSERIAL PRIMARY KEY,
+  hash BYTEA NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  timestamp BIGINT NOT NULL,
+  etag VARCHAR(255),
+  commit_id VARCHAR(64),
+  ruleset VARCHAR(64),
+  results TEXT NOT NULL,
+  missing BOOLEAN
+);
+CREATE INDEX scans_hash ON scans (hash);
+
+-- Existing results become the first scan in each history. Their path was
+-- never recorded, so it is left empty.
+INSERT INTO scans (hash, path, timestamp, etag, results, missing)
+  SELECT hash, '', timestamp, etag, results, missing FROM results;
+
+ALTER TABLE results ADD COLUMN scan_id BIGINT;
+UPDATE results SET scan_id = s.id FROM scans s WHERE s.hash = results.hash;
+ALTER TABLE results DROP COLUMN etag, DROP COLUMN results, DROP COLUMN missing;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+ALTER TABLE results ADD COLUMN etag VARCHAR(255), ADD COLUMN results TEXT, ADD COLUMN missing BOOLEAN;
+UPDATE results SET etag = s.etag, results = s.results, missing = s.missing FROM scans s WHERE s.id = results.scan_id;
+ALTER TABLE results DROP COLUMN scan_id;
+DROP TABLE IF EXISTS scans;
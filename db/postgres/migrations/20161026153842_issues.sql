@@ -0,0 +1,21 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE issues (
+  id BIGSERIAL PRIMARY KEY,
+  scan_id BIGINT NOT NULL,
+  repo VARCHAR(255) NOT NULL,
+  rule VARCHAR(16) NOT NULL,
+  file VARCHAR(1024) NOT NULL,
+  line INTEGER NOT NULL,
+  severity VARCHAR(16) NOT NULL,
+  confidence VARCHAR(16) NOT NULL,
+  details TEXT NOT NULL,
+  snippet TEXT NOT NULL
+);
+CREATE INDEX issues_scan ON issues (scan_id);
+CREATE INDEX issues_repo ON issues (repo);
+CREATE INDEX issues_rule ON issues (rule);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS issues;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE lock_generation (
+  value BIGINT NOT NULL
+);
+INSERT INTO lock_generation (value) VALUES (0);
+
+ALTER TABLE locks ADD COLUMN generation BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE results ADD COLUMN generation BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+ALTER TABLE results DROP COLUMN generation;
+ALTER TABLE locks DROP COLUMN generation;
+DROP TABLE IF EXISTS lock_generation;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE locks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  description VARCHAR(255) NOT NULL,
+  holder VARCHAR(255) NOT NULL,
+  timestamp INTEGER NOT NULL,
+  lifetime INTEGER NOT NULL
+);
+
+CREATE TABLE results (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  timestamp INTEGER NOT NULL,
+  etag VARCHAR(255),
+  results TEXT NOT NULL,
+  missing BOOLEAN
+);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS locks;
+DROP TABLE IF EXISTS results;
@@ -0,0 +1,48 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE scans (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  timestamp INTEGER NOT NULL,
+  etag VARCHAR(255),
+  commit_id VARCHAR(64),
+  ruleset VARCHAR(64),
+  results TEXT NOT NULL,
+  missing BOOLEAN
+);
+CREATE INDEX scans_hash ON scans (hash);
+
+-- Existing results become the first scan in each history. Their path was
+-- never recorded, so it is left empty.
+INSERT INTO scans (hash, path, timestamp, etag, results, missing)
+  SELECT hash, '', timestamp, etag, results, missing FROM results;
+
+-- SQLite before 3.35 can't drop columns, the table is rebuilt instead.
+CREATE TABLE results_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  timestamp INTEGER NOT NULL,
+  scan_id INTEGER
+);
+INSERT INTO results_history (id, hash, timestamp, scan_id)
+  SELECT r.id, r.hash, r.timestamp, (SELECT s.id FROM scans s WHERE s.hash = r.hash) FROM results r;
+DROP TABLE results;
+ALTER TABLE results_history RENAME TO results;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+CREATE TABLE results_legacy (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  timestamp INTEGER NOT NULL,
+  etag VARCHAR(255),
+  results TEXT NOT NULL,
+  missing BOOLEAN
+);
+INSERT INTO results_legacy (id, hash, timestamp, etag, results, missing)
+  SELECT r.id, r.hash, r.timestamp, s.etag, s.results, s.missing
+  FROM results r JOIN scans s ON s.id = r.scan_id;
+DROP TABLE results;
+ALTER TABLE results_legacy RENAME TO results;
+DROP TABLE IF EXISTS scans;
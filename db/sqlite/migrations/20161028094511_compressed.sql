@@ -0,0 +1,12 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+-- Existing rows are compressed on startup, see compressLegacyScans. SQLite
+-- stores blobs in the existing results column as they are.
+ALTER TABLE scans ADD COLUMN compressed BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+-- This migration is irreversible. Results are gzip-compressed from here on,
+-- which SQL can't undo, and reading them back as text would fail or corrupt
+-- them. The missing table makes rolling back fail before anything changes.
+SELECT 1 FROM irreversible_compressed_results;
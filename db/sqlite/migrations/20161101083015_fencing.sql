@@ -0,0 +1,39 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE lock_generation (
+  value BIGINT NOT NULL
+);
+INSERT INTO lock_generation (value) VALUES (0);
+
+ALTER TABLE locks ADD COLUMN generation BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE results ADD COLUMN generation BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+-- SQLite before 3.35 can't drop columns, the tables are rebuilt instead.
+CREATE TABLE results_unfenced (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  timestamp INTEGER NOT NULL,
+  scan_id INTEGER
+);
+INSERT INTO results_unfenced (id, hash, timestamp, scan_id)
+  SELECT id, hash, timestamp, scan_id FROM results;
+DROP TABLE results;
+ALTER TABLE results_unfenced RENAME TO results;
+CREATE INDEX results_timestamp ON results (timestamp);
+
+CREATE TABLE locks_unfenced (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB UNIQUE NOT NULL,
+  description VARCHAR(255) NOT NULL,
+  holder VARCHAR(255) NOT NULL,
+  timestamp INTEGER NOT NULL,
+  lifetime INTEGER NOT NULL
+);
+INSERT INTO locks_unfenced (id, hash, description, holder, timestamp, lifetime)
+  SELECT id, hash, description, holder, timestamp, lifetime FROM locks;
+DROP TABLE locks;
+ALTER TABLE locks_unfenced RENAME TO locks;
+
+DROP TABLE IF EXISTS lock_generation;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE TABLE uploads (
+  id VARCHAR(64) PRIMARY KEY,
+  token_hash BLOB NOT NULL,
+  timestamp INTEGER NOT NULL,
+  ruleset VARCHAR(64) NOT NULL,
+  results BLOB NOT NULL
+);
+CREATE INDEX uploads_timestamp ON uploads (timestamp);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP TABLE IF EXISTS uploads;
@@ -0,0 +1,468 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// A fetcher downloads the source trees of repositories.
+type fetcher interface {
+	// revision looks up the current revision of ref, or of the default
+	// branch if ref is empty. It returns errNotModified if the ETag still
+	// matches etag and errNotFound if there is no such repository or ref.
+	revision(ctx context.Context, repo, ref, etag string) (*revision, error)
+
+	// fetch stores the Go sources of rev below dir.
+	fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error)
+}
+
+// A sourceTree is a fetched copy of the Go sources of a repository.
+type sourceTree struct {
+	// dir is the root directory of the repository
+	dir string
+
+	// files are the Go files to analyse, relative to dir
+	files []string
+
+	// tests are the test files, which are only analysed if the scan
+	// configuration asks for it
+	tests []string
+
+	// commit is the full commit ID, if the source recorded it
+	commit string
+
+	// abbrev is an abbreviated commit ID, used if nothing better is known
+	abbrev string
+
+	// importPath is the import path of dir, if known. It is used to
+	// resolve imports of packages in the tree if there is no go.mod file.
+	importPath string
+}
+
+// isSourceFile tells if name, a slash-separated path, should be analysed.
+func isSourceFile(name string) bool {
+	return strings.HasSuffix(name, ".go") &&
+		!strings.Contains(name, "vendor/") &&
+		!strings.Contains(name, "testdata/") &&
+		!strings.HasSuffix(name, "_test.go")
+}
+
+// isTestFile tells if name is a test file of the files that are analysed.
+func isTestFile(name string) bool {
+	return strings.HasSuffix(name, "_test.go") &&
+		!strings.Contains(name, "vendor/") &&
+		!strings.Contains(name, "testdata/")
+}
+
+// isDependencyFile tells if name is needed to resolve imports of the files
+// that are analysed. This includes vendored code and go.mod files.
+func isDependencyFile(name string) bool {
+	if path.Base(name) == "go.mod" {
+		return true
+	}
+	return strings.HasSuffix(name, ".go") &&
+		!strings.Contains(name, "testdata/") &&
+		!strings.HasSuffix(name, "_test.go")
+}
+
+// isTreeFile tells if name is extracted from archives. Besides the files to
+// analyse and their dependencies, this includes tests and the scan
+// configuration.
+func isTreeFile(name string) bool {
+	return isDependencyFile(name) || isTestFile(name) || path.Base(name) == configFile
+}
+
+// An archiver is a remote host that serves repositories as tarballs.
+type archiver interface {
+	// archive downloads a gzip-compressed tarball of rev.
+	archive(ctx context.Context, repo string, rev *revision) (io.ReadCloser, error)
+}
+
+// fetchArchive downloads a tarball from a host and extracts it below dir.
+func fetchArchive(ctx context.Context, h archiver, repo string, rev *revision, dir string) (*sourceTree, error) {
+	body, err := h.archive(ctx, repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	defer io.Copy(ioutil.Discard, body)
+	defer body.Close()
+
+	return extractArchive(ctx, body, dir)
+}
+
+var (
+	errUnsupportedArchive = errors.New("unsupported archive format")
+	errArchiveTooLarge    = errors.New("archive too large")
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// extractArchive extracts the Go sources of a gzip-compressed tarball or a
+// zip archive below dir. If all files are in a single top-level directory,
+// like "user-repo-1234abc" for GitHub, the tree is rooted there. Other
+// formats fail with errUnsupportedArchive, and archives beyond the size
+// limits with errArchiveTooLarge.
+func extractArchive(ctx context.Context, r io.Reader, dir string) (*sourceTree, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err == io.EOF {
+		return nil, errUnsupportedArchive
+	} else if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+
+	e := &extractor{dir: dir, tree: &sourceTree{files: []string{}, tests: []string{}}}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		err = e.extractTar(ctx, br)
+	case bytes.HasPrefix(magic, zipMagic):
+		err = e.extractZip(ctx, br)
+	default:
+		return nil, errUnsupportedArchive
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.done(), nil
+}
+
+// An extractor writes the Go sources in an archive to disk. The same
+// filters and limits apply to every archive format.
+type extractor struct {
+	dir  string
+	tree *sourceTree
+
+	// root is the top-level directory of all entries so far, unless flat
+	// is set because some entries are in different places
+	root string
+	flat bool
+
+	// written is the number of bytes written to disk so far
+	written int64
+}
+
+// add writes an archive entry to disk if it is a Go file to analyse, or one
+// needed to resolve their imports or configure the scan.
+func (e *extractor) add(name string, info os.FileInfo, r io.Reader) error {
+	name = strings.TrimPrefix(name, "./")
+	path := filepath.FromSlash(name)
+	if strings.HasPrefix(filepath.Clean(path), "..") || filepath.IsAbs(path) {
+		return errors.Errorf("unable to extract archive (invalid path %s)", name)
+	}
+
+	// Every entry counts, the Go files may all be in a subdirectory
+	if parts := strings.SplitN(name, "/", 2); name != "" {
+		if (len(parts) < 2 && !info.IsDir()) || (e.root != "" && parts[0] != e.root) {
+			e.flat = true
+		}
+		e.root = parts[0]
+	}
+
+	if !info.Mode().IsRegular() || !isTreeFile(name) {
+		return nil
+	}
+
+	path = filepath.Join(e.dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+	limit := int64(archiveFileSize)
+	if left := archiveSizeLimit - e.written; left < limit {
+		limit = left
+	}
+	n, err := writeFile(path, r, limit)
+	e.written += n
+	if err == errArchiveTooLarge {
+		return err
+	} else if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+	if isSourceFile(name) {
+		e.tree.files = append(e.tree.files, filepath.Clean(filepath.FromSlash(name)))
+	} else if isTestFile(name) {
+		e.tree.tests = append(e.tree.tests, filepath.Clean(filepath.FromSlash(name)))
+	}
+	return nil
+}
+
+// done roots the tree at the top-level directory shared by all entries, if
+// there is one.
+func (e *extractor) done() *sourceTree {
+	tree := e.tree
+	tree.dir = e.dir
+	if e.flat || e.root == "" {
+		return tree
+	}
+
+	tree.dir = filepath.Join(e.dir, e.root)
+	for i, name := range tree.files {
+		tree.files[i], _ = filepath.Rel(e.root, name)
+	}
+	for i, name := range tree.tests {
+		tree.tests[i], _ = filepath.Rel(e.root, name)
+	}
+	if strings.Contains(e.root, "-") {
+		tree.abbrev = e.root[strings.LastIndex(e.root, "-")+1:]
+	}
+	return tree
+}
+
+func (e *extractor) extractTar(ctx context.Context, r io.Reader) error {
+	unzipped, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+
+	tr := tar.NewReader(&sizeLimitReader{r: unzipped, n: archiveSizeLimit, err: errArchiveTooLarge})
+	for i := 0; i < archiveFileLimit; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err == errArchiveTooLarge {
+			return err
+		} else if err != nil {
+			return errors.WrapPrefix(err, "unable to extract archive", 0)
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// GitHub records the full commit ID in the global header
+			if comment := header.PAXRecords["comment"]; commitID.MatchString(comment) {
+				e.tree.commit = comment
+			}
+			continue
+		}
+
+		if err := e.add(header.Name, header.FileInfo(), tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractZip needs random access to the archive, so it is spooled to a
+// temporary file below the extraction directory first.
+func (e *extractor) extractZip(ctx context.Context, r io.Reader) error {
+	spool, err := ioutil.TempFile(e.dir, ".archive")
+	if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := copyLimited(spool, r, archiveSizeLimit)
+	if err == errArchiveTooLarge {
+		return err
+	} else if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+
+	// GitHub records the full commit ID in the archive comment
+	if commitID.MatchString(zr.Comment) {
+		e.tree.commit = zr.Comment
+	}
+
+	for i, f := range zr.File {
+		if i >= archiveFileLimit {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := e.addZipFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) addZipFile(f *zip.File) error {
+	info := f.FileInfo()
+	if !info.Mode().IsRegular() || !isTreeFile(f.Name) {
+		// Checked here as well to avoid decompressing skipped files
+		return e.add(f.Name, info, nil)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return errors.WrapPrefix(err, "unable to extract archive", 0)
+	}
+	defer rc.Close()
+
+	return e.add(f.Name, info, rc)
+}
+
+// writeFile writes at most limit bytes from r to a new file at path. It
+// returns the number of bytes written, and errArchiveTooLarge if r has
+// more.
+func writeFile(path string, r io.Reader, limit int64) (int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := copyLimited(file, r, limit)
+	if err != nil {
+		return n, err
+	}
+	return n, file.Close()
+}
+
+// copyLimited copies at most limit bytes from r to w, and fails with
+// errArchiveTooLarge if r has more.
+func copyLimited(w io.Writer, r io.Reader, limit int64) (int64, error) {
+	n, err := io.Copy(w, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		return limit, errArchiveTooLarge
+	}
+	return n, err
+}
+
+// localHost serves repositories from a directory on disk, e.g. for tests
+// or for scanning sources that are not hosted anywhere. Each repository is
+// either a directory or a gzip-compressed tarball named after it with a
+// .tar.gz suffix.
+type localHost struct {
+	host string
+	root string
+}
+
+func newLocalHost(name, root string) *localHost {
+	return &localHost{name, root}
+}
+
+func (h *localHost) name() string {
+	return h.host
+}
+
+func (h *localHost) pattern() string {
+	return repoName + "(?:/" + repoName + ")*"
+}
+
+// revision uses the modification time and size of a tarball as its ETag.
+// Directories have no ETag, so they are scanned every time.
+func (h *localHost) revision(ctx context.Context, repo, ref, etag string) (*revision, error) {
+	if ref != "" {
+		// There is no history to pick refs from
+		return nil, errNotFound
+	}
+	for _, elem := range strings.Split(repo, "/") {
+		if elem == "." || elem == ".." {
+			return nil, errNotFound
+		}
+	}
+
+	path := filepath.Join(h.root, filepath.FromSlash(repo))
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return &revision{}, nil
+	}
+
+	info, err := os.Stat(path + ".tar.gz")
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	rev := &revision{ETag: fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())}
+	if rev.ETag == etag {
+		return nil, errNotModified
+	}
+	return rev, nil
+}
+
+// fetch reads directories in place, only tarballs are extracted to dir.
+func (h *localHost) fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error) {
+	path := filepath.Join(h.root, filepath.FromSlash(repo))
+	if rev.ETag != "" {
+		file, err := os.Open(path + ".tar.gz")
+		if err != nil {
+			return nil, errors.New(err)
+		}
+		defer file.Close()
+
+		tree, err := extractArchive(ctx, file, dir)
+		if err != nil {
+			return nil, err
+		}
+		tree.importPath = repo
+
+		// Anyone with access to the directory can claim any commit, so
+		// only the abbreviated one is kept, which is never looked up to
+		// reuse results
+		tree.commit = ""
+		if commitID.MatchString(tree.abbrev) {
+			tree.abbrev = tree.abbrev[:7]
+		}
+		return tree, nil
+	}
+
+	// Directories below the root may well be laid out like a GOPATH
+	tree := &sourceTree{dir: path, files: []string{}, tests: []string{}, importPath: repo}
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(tree.files) >= archiveFileLimit {
+			return filepath.SkipDir
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isSourceFile(filepath.ToSlash(rel)) {
+			tree.files = append(tree.files, rel)
+		} else if isTestFile(filepath.ToSlash(rel)) {
+			tree.tests = append(tree.tests, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to read %s", path), 0)
+	}
+	return tree, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+var errLostLock = errors.New("lost lock, aborting")
+
+// heartbeat refreshes a lock in the background for as long as the work it
+// protects is running.
+type heartbeat struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// startHeartbeat refreshes l every interval until stop is called. The
+// returned heartbeat's context is cancelled as soon as a refresh fails, so
+// that the work can be aborted before the lease runs out.
+func startHeartbeat(parent context.Context, l lock, interval time.Duration) *heartbeat {
+	ctx, cancel := context.WithCancel(parent)
+	hb := &heartbeat{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(hb.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.refresh(); err != nil {
+					hb.err = err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return hb
+}
+
+// stop ends the heartbeat and waits for a refresh in flight to finish. It
+// returns errLostLock if the lock could not be refreshed at some point.
+func (hb *heartbeat) stop() error {
+	hb.cancel()
+	<-hb.done
+
+	if hb.err != nil {
+		logError("unable to refresh lock", hb.err)
+		return errLostLock
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatKeepsLock(t *testing.T) {
+	db := newMemoryDatabase()
+	path := testPath()
+
+	l, err := db.lockPath("node-a", path, 100*time.Millisecond)
+	if err != nil || l == nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+
+	hb := startHeartbeat(context.Background(), l, 20*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+
+	if other, err := db.lockPath("node-b", path, time.Minute); err != nil || other != nil {
+		t.Fatalf("expected lock to be kept alive (%v)", err)
+	}
+	if hb.ctx.Err() != nil {
+		t.Fatal("heartbeat cancelled while holding the lock")
+	}
+	if err := hb.stop(); err != nil {
+		t.Fatalf("unexpected error stopping heartbeat: %v", err)
+	}
+}
+
+func TestHeartbeatCancelsOnLostLock(t *testing.T) {
+	db := newMemoryDatabase()
+	path := testPath()
+
+	l, err := db.lockPath("node-a", path, 10*time.Millisecond)
+	if err != nil || l == nil {
+		t.Fatalf("unable to acquire lock: %v", err)
+	}
+
+	hb := startHeartbeat(context.Background(), l, 100*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// Lease ran out before the first refresh
+	if other, err := db.lockPath("node-b", path, time.Minute); err != nil || other == nil {
+		t.Fatalf("unable to take over expired lock: %v", err)
+	}
+
+	select {
+	case <-hb.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat not cancelled after losing the lock")
+	}
+	if err := hb.stop(); err != errLostLock {
+		t.Fatalf("expected errLostLock, got %v", err)
+	}
+}
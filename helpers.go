@@ -14,6 +14,12 @@
 package main
 
 import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/go-errors/errors"
 )
 
@@ -26,3 +32,55 @@ func logError(msg string, err interface{}) {
 		}
 	}
 }
+
+// acceptsGzip checks if the client accepts gzip-encoded responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		name := strings.TrimSpace(parts[0])
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+// if the variable is not set.
+func envInt(name string, def int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		logger.Fatalf("invalid number for %s: %q", name, value)
+	}
+	return n
+}
+
+// envDuration reads a duration such as "36h" from the environment, falling
+// back to def if the variable is not set.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		logger.Fatalf("invalid duration for %s: %q", name, value)
+	}
+	return d
+}
@@ -0,0 +1,588 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gorilla/mux"
+)
+
+// A revision identifies the state of a repository on its host.
+type revision struct {
+	// ETag is an opaque version tag, used to tell if anything changed
+	// since the last scan.
+	ETag string
+
+	// Commit is the full commit ID, if the host told us.
+	Commit string
+
+	// Ref is the branch, tag or commit the revision was read from, empty
+	// for the default branch on hosts that don't need to know it.
+	Ref string
+}
+
+// A host is a code hosting service that repositories can be fetched from.
+// Repositories are named by their path on the host, e.g. "user/repo".
+// Result paths may pin a branch, tag or commit, e.g. "user/repo@v1.2.0".
+type host interface {
+	fetcher
+
+	// name is the first element of result paths for the host.
+	name() string
+
+	// pattern is the route pattern matching repository names.
+	pattern() string
+}
+
+// A throttledHost is a host with a limited API budget. Jobs for it are held
+// back while the budget is used up instead of failing.
+type throttledHost interface {
+	host
+
+	// throttled returns how long until the budget is renewed, or zero if
+	// there is budget left.
+	throttled() time.Duration
+
+	// rateLimits reports the current budget.
+	rateLimits() []rateLimit
+}
+
+// A browsableHost serves repositories on the web. Results of other hosts
+// don't link to their sources.
+type browsableHost interface {
+	host
+
+	// links returns the web addresses of a repository at rev.
+	links(repo, rev string) *repoLinks
+}
+
+// repoLinks are the web addresses of a repository, put in the results so
+// that clients don't need to know the URL layout of each host.
+type repoLinks struct {
+	Repo string `json:"repo"`
+
+	// File is a template for the address of a line of a file, with {file}
+	// and {line} to be filled in
+	File string `json:"file"`
+}
+
+// linksOf returns the web addresses of a repository at rev, or its default
+// branch if rev is empty, if its host serves repositories on the web.
+func linksOf(h host, repo, rev string) *repoLinks {
+	b, ok := h.(browsableHost)
+	if !ok {
+		return nil
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+	return b.links(repo, rev)
+}
+
+const (
+	// repoName matches a single path element of a repository name
+	repoName = "[a-zA-Z0-9-_.]+"
+
+	// refName matches the branches, tags, commits and module versions that
+	// can be scanned, e.g. "v2.0.0+incompatible"
+	refName = "[a-zA-Z0-9-_.+]+(?:/[a-zA-Z0-9-_.+]+)*"
+)
+
+// splitRef splits the ref, if any, off a repository name.
+func splitRef(repo string) (string, string) {
+	if i := strings.Index(repo, "@"); i >= 0 {
+		return repo[:i], repo[i+1:]
+	}
+	return repo, ""
+}
+
+// hostRepo splits a result path into its host and repository name.
+func hostRepo(hosts map[string]host, path string) (host, string, error) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return nil, "", errors.Errorf("invalid path %s", path)
+	}
+
+	h, ok := hosts[parts[0]]
+	if !ok {
+		return nil, "", errors.Errorf("unsupported host %s", parts[0])
+	}
+	return h, parts[1], nil
+}
+
+// requestPath returns the result path of a request routed with the host,
+// repo and optionally ref variables.
+func requestPath(req *http.Request) string {
+	vars := mux.Vars(req)
+	if ref := vars["ref"]; ref != "" {
+		return vars["host"] + "/" + vars["repo"] + "@" + ref
+	}
+	return vars["host"] + "/" + vars["repo"]
+}
+
+// get performs a request and maps common status codes to errors. The
+// caller must close the body on success.
+func get(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	return getWith(ctx, http.DefaultClient, method, url, header)
+}
+
+// getWith is like get, but sends the request with the given client.
+func getWith(ctx context.Context, client *http.Client, method, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusNotModified:
+		err = errNotModified
+	case http.StatusNotFound:
+		err = errNotFound
+	default:
+		err = errors.Errorf("unable to fetch %s (%s)", url, res.Status)
+	}
+
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return nil, err
+}
+
+// githubHost downloads repositories through the GitHub API. Requests are
+// authenticated with a pool of tokens, if configured, and held back once
+// the budget of all tokens is used up.
+type githubHost struct {
+	api    string
+	pool   *tokenPool
+	client *http.Client
+
+	// private is set for hosts acting for a signed in user. Other hosts
+	// treat private repositories as missing, even if a token could read
+	// them, so that they never end up in the public results.
+	private bool
+}
+
+// newGitHubHost creates a host talking to the GitHub API at api, usually
+// https://api.github.com.
+func newGitHubHost(api string, tokens []string) (*githubHost, error) {
+	u, err := url.Parse(strings.TrimSuffix(api, "/"))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid GitHub API URL", 0)
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("invalid GitHub API URL %s", api)
+	}
+
+	pool := newTokenPool(tokens)
+	return &githubHost{
+		api:  u.String(),
+		pool: pool,
+		client: &http.Client{
+			Transport: &rateLimitTransport{u.Host, pool, http.DefaultTransport},
+		},
+	}, nil
+}
+
+// withToken returns a copy of the host that makes all requests with the
+// token of a signed in user, against that user's rate limit.
+func (h *githubHost) withToken(token string) *githubHost {
+	u, _ := url.Parse(h.api)
+	pool := newTokenPool([]string{token})
+	return &githubHost{
+		api:  h.api,
+		pool: pool,
+		client: &http.Client{
+			Transport: &rateLimitTransport{u.Host, pool, http.DefaultTransport},
+		},
+		private: true,
+	}
+}
+
+// login returns the name of the user the host's token belongs to.
+func (h *githubHost) login(ctx context.Context) (string, error) {
+	res, err := getWith(ctx, h.client, "GET", h.api+"/user", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil || user.Login == "" {
+		return "", errors.Errorf("unable to look up user (%v)", err)
+	}
+	return user.Login, nil
+}
+
+// isPrivate tells if a repository is private. It returns errNotFound if
+// the repository does not exist or the token can't read it.
+func (h *githubHost) isPrivate(ctx context.Context, repo string) (bool, error) {
+	res, err := getWith(ctx, h.client, "GET", fmt.Sprintf("%s/repos/%s", h.api, repo), nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	var info struct {
+		Private bool `json:"private"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return false, errors.WrapPrefix(err, fmt.Sprintf("unable to look up %s", repo), 0)
+	}
+	return info.Private, nil
+}
+
+func (h *githubHost) name() string {
+	return "github.com"
+}
+
+func (h *githubHost) links(repo, rev string) *repoLinks {
+	web := "https://github.com/" + repo
+	return &repoLinks{web, web + "/blob/" + url.PathEscape(rev) + "/{file}#L{line}"}
+}
+
+func (h *githubHost) pattern() string {
+	return repoName + "/" + repoName
+}
+
+func (h *githubHost) throttled() time.Duration {
+	return h.pool.throttled()
+}
+
+func (h *githubHost) rateLimits() []rateLimit {
+	return h.pool.budget()
+}
+
+func (h *githubHost) tarball(repo, ref string) string {
+	if ref == "" {
+		return fmt.Sprintf("%s/repos/%s/tarball", h.api, repo)
+	}
+	return fmt.Sprintf("%s/repos/%s/tarball/%s", h.api, repo, ref)
+}
+
+func (h *githubHost) revision(ctx context.Context, repo, ref, etag string) (*revision, error) {
+	header := http.Header{}
+	if etag != "" {
+		// Conditional requests answered with 304 don't count against
+		// the rate limit
+		header.Set("If-None-Match", etag)
+	}
+	res, err := getWith(ctx, h.client, "HEAD", h.tarball(repo, ref), header)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	rev := &revision{ETag: res.Header.Get("ETag"), Ref: ref}
+	if rev.ETag != "" && rev.ETag == etag {
+		return nil, errNotModified
+	}
+
+	if !h.private {
+		private, err := h.isPrivate(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		if private {
+			logger.Printf("refusing to scan private repository %s", repo)
+			return nil, errNotFound
+		}
+	}
+
+	// The commit is resolved after the ETag was read, so that a push in
+	// between can't leave us with an ETag newer than the results.
+	rev.Commit, err = h.resolveCommit(ctx, repo, ref)
+	if err != nil {
+		logError(fmt.Sprintf("unable to resolve commit of %s", repo), err)
+	}
+	return rev, nil
+}
+
+func (h *githubHost) fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error) {
+	return fetchArchive(ctx, h, repo, rev, dir)
+}
+
+func (h *githubHost) archive(ctx context.Context, repo string, rev *revision) (io.ReadCloser, error) {
+	res, err := getWith(ctx, h.client, "GET", h.tarball(repo, rev.Ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// resolveCommit asks GitHub for the full ID of the commit that ref, or the
+// default branch of a repository, points at.
+func (h *githubHost) resolveCommit(ctx context.Context, repo, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	res, err := getWith(ctx, h.client, "GET", fmt.Sprintf("%s/repos/%s/commits/%s", h.api, repo, ref),
+		http.Header{"Accept": {"application/vnd.github.sha"}})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, 128))
+	if err != nil {
+		return "", errors.New(err)
+	}
+
+	commit := strings.TrimSpace(string(raw))
+	if !commitID.MatchString(commit) {
+		return "", errors.Errorf("unable to resolve commit (invalid ID %q)", commit)
+	}
+	return commit, nil
+}
+
+// gitlabHost talks to the API of gitlab.com or a self-hosted instance.
+// Projects may be nested in several levels of groups.
+type gitlabHost struct {
+	base *url.URL
+}
+
+// newGitLabHost creates a host for the GitLab instance at base, e.g.
+// https://gitlab.example.com. Results are stored under its host name.
+func newGitLabHost(base string) (*gitlabHost, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid GitLab URL", 0)
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("invalid GitLab URL %s", base)
+	}
+	return &gitlabHost{u}, nil
+}
+
+func (h *gitlabHost) name() string {
+	return h.base.Host
+}
+
+func (h *gitlabHost) links(repo, rev string) *repoLinks {
+	web := h.base.String() + "/" + repo
+	return &repoLinks{web, web + "/-/blob/" + url.PathEscape(rev) + "/{file}#L{line}"}
+}
+
+func (h *gitlabHost) pattern() string {
+	return repoName + "(?:/" + repoName + ")+"
+}
+
+// project returns the API URL of a project, addressed by its full path.
+func (h *gitlabHost) project(repo string) string {
+	return h.base.String() + "/api/v4/projects/" + url.PathEscape(repo)
+}
+
+// revision looks up the latest commit of ref. GitLab does not send an ETag
+// for archives, so the commit ID doubles as one.
+func (h *gitlabHost) revision(ctx context.Context, repo, ref, etag string) (*revision, error) {
+	query := url.Values{"per_page": {"1"}}
+	if ref != "" {
+		query.Set("ref_name", ref)
+	}
+
+	res, err := get(ctx, "GET", h.project(repo)+"/repository/commits?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	commits := []struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&commits); err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to look up commits of %s", repo), 0)
+	}
+	if len(commits) == 0 {
+		// Empty repositories have nothing to scan
+		return nil, errNotFound
+	}
+
+	commit := commits[0].ID
+	if !commitID.MatchString(commit) {
+		return nil, errors.Errorf("unable to look up commits of %s (invalid ID %q)", repo, commit)
+	}
+	if commit == etag {
+		return nil, errNotModified
+	}
+	return &revision{ETag: commit, Commit: commit, Ref: ref}, nil
+}
+
+func (h *gitlabHost) fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error) {
+	return fetchArchive(ctx, h, repo, rev, dir)
+}
+
+func (h *gitlabHost) archive(ctx context.Context, repo string, rev *revision) (io.ReadCloser, error) {
+	res, err := get(ctx, "GET", h.project(repo)+"/repository/archive.tar.gz?sha="+url.QueryEscape(rev.Commit), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// bitbucketHost downloads repositories from Bitbucket Cloud.
+type bitbucketHost struct {
+	api string
+	web string
+}
+
+// newBitbucketHost creates a host talking to the Bitbucket API at api and
+// downloading archives from web, usually https://api.bitbucket.org/2.0 and
+// https://bitbucket.org. Results are stored under bitbucket.org either way.
+func newBitbucketHost(api, web string) (*bitbucketHost, error) {
+	for _, base := range []string{api, web} {
+		u, err := url.Parse(base)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("invalid Bitbucket URL %s", base)
+		}
+	}
+	return &bitbucketHost{
+		api: strings.TrimSuffix(api, "/"),
+		web: strings.TrimSuffix(web, "/"),
+	}, nil
+}
+
+func (h *bitbucketHost) name() string {
+	return "bitbucket.org"
+}
+
+func (h *bitbucketHost) links(repo, rev string) *repoLinks {
+	web := h.web + "/" + repo
+	return &repoLinks{web, web + "/src/" + url.PathEscape(rev) + "/{file}#lines-{line}"}
+}
+
+func (h *bitbucketHost) pattern() string {
+	return repoName + "/" + repoName
+}
+
+func (h *bitbucketHost) archiveURL(repo, ref string) string {
+	return fmt.Sprintf("%s/%s/get/%s.tar.gz", h.web, repo, url.PathEscape(ref))
+}
+
+// revision checks the ETag of the archive of ref, or of the main branch,
+// just like for GitHub. The commit is looked up after the ETag was read,
+// and stands in for it if there is none.
+func (h *bitbucketHost) revision(ctx context.Context, repo, ref, etag string) (*revision, error) {
+	if ref == "" {
+		var err error
+		if ref, err = h.mainBranch(ctx, repo); err != nil {
+			return nil, err
+		}
+	}
+	rev := &revision{Ref: ref}
+
+	res, err := get(ctx, "HEAD", h.archiveURL(repo, rev.Ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	rev.ETag = res.Header.Get("ETag")
+	if rev.ETag != "" && rev.ETag == etag {
+		return nil, errNotModified
+	}
+
+	rev.Commit, err = h.resolveCommit(ctx, repo, rev.Ref)
+	if err != nil {
+		logError(fmt.Sprintf("unable to resolve commit of %s", repo), err)
+	}
+
+	if rev.ETag == "" && rev.Commit != "" {
+		rev.ETag = `"` + rev.Commit + `"`
+		if rev.ETag == etag {
+			return nil, errNotModified
+		}
+	}
+	return rev, nil
+}
+
+func (h *bitbucketHost) mainBranch(ctx context.Context, repo string) (string, error) {
+	res, err := get(ctx, "GET", fmt.Sprintf("%s/repositories/%s", h.api, repo), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var info struct {
+		MainBranch struct {
+			Name string `json:"name"`
+		} `json:"mainbranch"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return "", errors.WrapPrefix(err, fmt.Sprintf("unable to look up %s", repo), 0)
+	}
+	if info.MainBranch.Name == "" {
+		// Empty repositories have no main branch
+		return "", errNotFound
+	}
+	return info.MainBranch.Name, nil
+}
+
+// resolveCommit looks up the commit of a branch, tag or commit ID.
+func (h *bitbucketHost) resolveCommit(ctx context.Context, repo, ref string) (string, error) {
+	res, err := get(ctx, "GET", fmt.Sprintf("%s/repositories/%s/commit/%s", h.api, repo, url.PathEscape(ref)), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var commit struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&commit); err != nil {
+		return "", errors.New(err)
+	}
+	if !commitID.MatchString(commit.Hash) {
+		return "", errors.Errorf("unable to resolve commit (invalid ID %q)", commit.Hash)
+	}
+	return commit.Hash, nil
+}
+
+func (h *bitbucketHost) fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error) {
+	return fetchArchive(ctx, h, repo, rev, dir)
+}
+
+// archive downloads the commit the revision resolved to, so that a push in
+// between can't change what is scanned. Only the ref is known if resolving
+// the commit failed.
+func (h *bitbucketHost) archive(ctx context.Context, repo string, rev *revision) (io.ReadCloser, error) {
+	ref := rev.Commit
+	if ref == "" {
+		ref = rev.Ref
+	}
+	res, err := get(ctx, "GET", h.archiveURL(repo, ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
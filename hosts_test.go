@@ -0,0 +1,261 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGitLabHost(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	tagged := "89abcdef0123456789abcdef0123456789abcdef"
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fsub%2Fproject/repository/commits":
+			switch req.URL.Query().Get("ref_name") {
+			case "":
+				resp.Write([]byte(`[{"id":"` + commit + `"}]`))
+			case "v1.0.0":
+				resp.Write([]byte(`[{"id":"` + tagged + `"}]`))
+			default:
+				resp.WriteHeader(http.StatusNotFound)
+			}
+		case "/api/v4/projects/group%2Fsub%2Fproject/repository/archive.tar.gz":
+			if req.URL.Query().Get("sha") != commit {
+				t.Errorf("unexpected archive request %s", req.URL)
+			}
+			resp.Write([]byte("archive"))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	h, err := newGitLabHost(server.URL + "/")
+	if err != nil {
+		t.Fatalf("unable to create host: %v", err)
+	}
+	if h.name() != server.Listener.Addr().String() {
+		t.Fatalf("unexpected name %s", h.name())
+	}
+
+	ctx := context.Background()
+	rev, err := h.revision(ctx, "group/sub/project", "", "")
+	if err != nil {
+		t.Fatalf("unable to look up revision: %v", err)
+	}
+	if rev.Commit != commit || rev.ETag != commit {
+		t.Fatalf("unexpected revision %+v", rev)
+	}
+
+	if _, err := h.revision(ctx, "group/sub/project", "", commit); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+	if _, err := h.revision(ctx, "group/missing", "", ""); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+
+	pinned, err := h.revision(ctx, "group/sub/project", "v1.0.0", "")
+	if err != nil || pinned.Commit != tagged || pinned.Ref != "v1.0.0" {
+		t.Fatalf("unexpected revision %+v (%v)", pinned, err)
+	}
+
+	body, err := h.archive(ctx, "group/sub/project", rev)
+	if err != nil {
+		t.Fatalf("unable to download archive: %v", err)
+	}
+	defer body.Close()
+	if raw, _ := ioutil.ReadAll(body); string(raw) != "archive" {
+		t.Fatalf("unexpected archive %q", raw)
+	}
+}
+
+func TestHostRepo(t *testing.T) {
+	github, _ := newGitHubHost("https://api.github.com", nil)
+	gitlab, _ := newGitLabHost("https://gitlab.com")
+	hosts := map[string]host{"github.com": github, "gitlab.com": gitlab}
+
+	h, repo, err := hostRepo(hosts, "gitlab.com/group/sub/project")
+	if err != nil || h != gitlab || repo != "group/sub/project" {
+		t.Fatalf("unexpected split %v, %s (%v)", h, repo, err)
+	}
+	if _, _, err := hostRepo(hosts, "example.com/user/repo"); err == nil {
+		t.Fatal("expected error for unsupported host")
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	gitlab, _ := newGitLabHost("https://gitlab.com")
+	proxy, _ := newModuleProxy("https://proxy.golang.org")
+	github, _ := newGitHubHost("https://api.github.com", nil)
+	bitbucket, _ := newBitbucketHost("https://api.bitbucket.org/2.0", "https://bitbucket.org")
+	w := newTestWorker(map[string]host{"gitlab.com": gitlab, "mod": proxy, "github.com": github, "bitbucket.org": bitbucket})
+	r := mux.NewRouter()
+	w.handleHosts(r, &headerWrapper{})
+
+	for path, expected := range map[string]string{
+		"/results/gitlab.com/group/project":                 "results",
+		"/results/gitlab.com/group/history":                 "results",
+		"/results/gitlab.com/group/project/-/history":       "history",
+		"/results/gitlab.com/group/project/-/history/42":    "scan",
+		"/results/gitlab.com/group/project@v1/-/history":    "history",
+		"/results/mod/example.com/history":                  "results",
+		"/results/mod/example.com/history@v1.0.0/-/history": "history",
+		"/results/github.com/user/repo/history":             "history",
+		"/results/github.com/user/repo/history/42":          "scan",
+		"/results/github.com/user/repo@v1/history":          "history",
+		"/results/github.com/user/repo/-/history":           "history",
+		"/results/bitbucket.org/owner/repo/history":         "history",
+	} {
+		var match mux.RouteMatch
+		if !r.Match(httptest.NewRequest("GET", path, nil), &match) {
+			t.Errorf("%s: no route", path)
+		} else if match.Route.GetName() != expected {
+			t.Errorf("%s: expected %s route, got %s", path, expected, match.Route.GetName())
+		}
+	}
+}
+
+func TestBitbucketHost(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/repositories/owner/repo":
+			resp.Write([]byte(`{"mainbranch":{"name":"main"}}`))
+		case "/api/repositories/owner/repo/commit/main", "/api/repositories/owner/repo/commit/v1.0.0":
+			resp.Write([]byte(`{"hash":"` + commit + `"}`))
+		case "/web/owner/repo/get/main.tar.gz", "/web/owner/repo/get/v1.0.0.tar.gz":
+			// Archives of branches and tags may change any time
+			resp.Header().Set("ETag", `"`+path.Base(req.URL.Path)+`"`)
+			if req.Method == "GET" {
+				resp.Write([]byte("moving archive"))
+			}
+		case "/web/owner/repo/get/" + commit + ".tar.gz":
+			if req.Method == "GET" {
+				resp.Write([]byte("archive"))
+			}
+		case "/api/repositories/owner/untagged":
+			resp.Write([]byte(`{"mainbranch":{"name":"main"}}`))
+		case "/api/repositories/owner/untagged/commit/main":
+			resp.Write([]byte(`{"hash":"` + commit + `"}`))
+		case "/web/owner/untagged/get/main.tar.gz":
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := newBitbucketHost("ftp://example.com", server.URL); err == nil {
+		t.Fatal("expected invalid API URL to be rejected")
+	}
+	h, err := newBitbucketHost(server.URL+"/api/", server.URL+"/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	rev, err := h.revision(ctx, "owner/repo", "", "")
+	if err != nil {
+		t.Fatalf("unable to look up revision: %v", err)
+	}
+	if rev.ETag != `"main.tar.gz"` || rev.Commit != commit || rev.Ref != "main" {
+		t.Fatalf("unexpected revision %+v", rev)
+	}
+
+	if _, err := h.revision(ctx, "owner/repo", "", `"main.tar.gz"`); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+	if _, err := h.revision(ctx, "owner/missing", "", ""); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+
+	pinned, err := h.revision(ctx, "owner/repo", "v1.0.0", "")
+	if err != nil || pinned.ETag != `"v1.0.0.tar.gz"` || pinned.Ref != "v1.0.0" {
+		t.Fatalf("unexpected revision %+v (%v)", pinned, err)
+	}
+	if _, err := h.revision(ctx, "owner/repo", "missing", ""); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+
+	// The commit stands in for a missing ETag
+	untagged, err := h.revision(ctx, "owner/untagged", "", "")
+	if err != nil || untagged.ETag != `"`+commit+`"` {
+		t.Fatalf("unexpected revision %+v (%v)", untagged, err)
+	}
+	if _, err := h.revision(ctx, "owner/untagged", "", untagged.ETag); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+
+	body, err := h.archive(ctx, "owner/repo", rev)
+	if err != nil {
+		t.Fatalf("unable to download archive: %v", err)
+	}
+	defer body.Close()
+	if raw, _ := ioutil.ReadAll(body); string(raw) != "archive" {
+		t.Fatalf("unexpected archive %q", raw)
+	}
+}
+
+func TestSplitRef(t *testing.T) {
+	for path, expected := range map[string][2]string{
+		"user/repo":               {"user/repo", ""},
+		"user/repo@v1.2.0":        {"user/repo", "v1.2.0"},
+		"group/sub/project@a/b/c": {"group/sub/project", "a/b/c"},
+	} {
+		repo, ref := splitRef(path)
+		if repo != expected[0] || ref != expected[1] {
+			t.Errorf("split %s into %s, %s", path, repo, ref)
+		}
+	}
+}
+
+func TestRepoLinks(t *testing.T) {
+	github, _ := newGitHubHost("https://api.github.com", nil)
+	gitlab, _ := newGitLabHost("https://gitlab.example.com")
+	bitbucket, _ := newBitbucketHost("https://api.bitbucket.org/2.0", "https://bitbucket.org")
+	proxy, _ := newModuleProxy("https://proxy.golang.org")
+
+	for _, c := range []struct {
+		h         host
+		repo, rev string
+		web, file string
+	}{
+		{github, "user/repo", "", "https://github.com/user/repo", "https://github.com/user/repo/blob/HEAD/{file}#L{line}"},
+		{gitlab, "group/sub/project", "0123456", "https://gitlab.example.com/group/sub/project",
+			"https://gitlab.example.com/group/sub/project/-/blob/0123456/{file}#L{line}"},
+		{bitbucket, "owner/repo", "main", "https://bitbucket.org/owner/repo",
+			"https://bitbucket.org/owner/repo/src/main/{file}#lines-{line}"},
+	} {
+		links := linksOf(c.h, c.repo, c.rev)
+		if links == nil || links.Repo != c.web || links.File != c.file {
+			t.Errorf("unexpected links for %s: %+v", c.repo, links)
+		}
+	}
+
+	// Modules and local sources aren't browsable
+	for _, h := range []host{proxy, newLocalHost("local", "/")} {
+		if links := linksOf(h, "example.com/module", ""); links != nil {
+			t.Errorf("unexpected links for %s: %+v", h.name(), links)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// sourceImporter type-checks imported packages from source, so that types
+// from dependencies are known to the rules. Imports are resolved from the
+// vendor directories of the importing package, the packages of its own
+// module and, if configured, a module cache laid out like the one of the
+// go command. The standard library is imported from compiled packages.
+type sourceImporter struct {
+	fset *token.FileSet
+	std  types.Importer
+
+	// root is the directory of the tree and importPath its import path,
+	// which is used if the tree has no go.mod file
+	root       string
+	importPath string
+
+	// cache is the module cache directory, if any
+	cache string
+
+	// packages are the packages imported so far, by directory. A nil
+	// package is still being imported.
+	packages map[string]*types.Package
+	modules  map[string]*goModule
+}
+
+func newSourceImporter(fset *token.FileSet, tree *sourceTree, cache string) *sourceImporter {
+	return &sourceImporter{
+		fset:       fset,
+		std:        importer.Default(),
+		root:       tree.dir,
+		importPath: tree.importPath,
+		cache:      cache,
+		packages:   map[string]*types.Package{},
+		modules:    map[string]*goModule{},
+	}
+}
+
+func (i *sourceImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, i.root, 0)
+}
+
+// ImportFrom imports path for the package in dir.
+func (i *sourceImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	// Only the standard library has import paths without a dot in the
+	// first element, but GOPATH-era vendor directories might not care
+	if !strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+		if pkg, err := i.std.Import(path); err == nil {
+			return pkg, nil
+		}
+	}
+
+	src := i.resolve(path, dir)
+	if src == "" {
+		return nil, errors.Errorf("unable to resolve import %s", path)
+	}
+	return i.load(path, src)
+}
+
+// resolve returns the directory holding the sources of path, or an empty
+// string if it's nowhere to be found.
+func (i *sourceImporter) resolve(path, dir string) string {
+	if !validImportPath(path) {
+		return ""
+	}
+	rel := filepath.FromSlash(path)
+
+	if within(i.root, dir) {
+		for d := dir; ; d = filepath.Dir(d) {
+			if candidate := filepath.Join(d, "vendor", rel); isDir(candidate) {
+				return candidate
+			}
+			if d == i.root {
+				break
+			}
+		}
+	}
+
+	mod := i.module(dir)
+	if mod == nil {
+		return ""
+	}
+	if path == mod.path || strings.HasPrefix(path, mod.path+"/") {
+		candidate := filepath.Join(mod.dir, filepath.FromSlash(strings.TrimPrefix(path, mod.path)))
+		if isDir(candidate) {
+			return candidate
+		}
+	}
+
+	if i.cache == "" {
+		return ""
+	}
+	required := ""
+	for p := range mod.requires {
+		if (path == p || strings.HasPrefix(path, p+"/")) && len(p) > len(required) {
+			required = p
+		}
+	}
+	if required == "" || !validImportPath(required) {
+		return ""
+	}
+	candidate := filepath.Join(
+		i.cache,
+		filepath.FromSlash(escapeModulePath(required)+"@"+escapeModulePath(mod.requires[required])),
+		filepath.FromSlash(strings.TrimPrefix(path, required)))
+	if within(i.cache, candidate) && isDir(candidate) {
+		return candidate
+	}
+	return ""
+}
+
+// load type-checks the package in dir. Function bodies don't matter to
+// importers and are skipped.
+func (i *sourceImporter) load(path, dir string) (*types.Package, error) {
+	if pkg, ok := i.packages[dir]; ok {
+		if pkg == nil {
+			return nil, errors.Errorf("import cycle through %s", path)
+		}
+		return pkg, nil
+	}
+	i.packages[dir] = nil
+
+	bp, err := build.Default.ImportDir(dir, 0)
+	if bp == nil || len(bp.GoFiles)+len(bp.CgoFiles) == 0 {
+		delete(i.packages, dir)
+		return nil, errors.Errorf("unable to import %s (%v)", path, err)
+	}
+
+	files := []*ast.File{}
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		file, err := parser.ParseFile(i.fset, filepath.Join(dir, name), nil, 0)
+		if err == nil {
+			files = append(files, file)
+		}
+	}
+
+	conf := types.Config{
+		Importer:         i,
+		IgnoreFuncBodies: true,
+		FakeImportC:      true,
+		Error:            func(error) {},
+	}
+	pkg, _ := conf.Check(path, i.fset, files, nil)
+	i.packages[dir] = pkg
+	return pkg, nil
+}
+
+// A goModule is the part of a go.mod file needed to resolve imports.
+type goModule struct {
+	dir      string
+	path     string
+	requires map[string]string
+}
+
+// module returns the module the package in dir belongs to. Without a
+// go.mod file, the tree is taken to be a module named after its import
+// path.
+func (i *sourceImporter) module(dir string) *goModule {
+	root := i.root
+	if !within(root, dir) {
+		if i.cache == "" || !within(i.cache, dir) {
+			return nil
+		}
+		root = i.cache
+	}
+
+	for d := dir; ; d = filepath.Dir(d) {
+		if mod, ok := i.modules[d]; ok {
+			return mod
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(d, "go.mod")); err == nil {
+			i.modules[d] = parseGoMod(d, data)
+			return i.modules[d]
+		}
+		if d == root || d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	if root == i.root && i.importPath != "" {
+		return &goModule{dir: i.root, path: i.importPath}
+	}
+	return nil
+}
+
+// parseGoMod reads the module path and requirements of a go.mod file.
+// Anything else in the file is ignored.
+func parseGoMod(dir string, data []byte) *goModule {
+	mod := &goModule{dir: dir, requires: map[string]string{}}
+
+	block := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		for j, f := range fields {
+			if unquoted, err := strconv.Unquote(f); err == nil {
+				fields[j] = unquoted
+			}
+		}
+
+		switch {
+		case len(fields) == 0:
+		case fields[0] == ")":
+			block = ""
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+		case block == "require" && len(fields) >= 2:
+			mod.requires[fields[0]] = fields[1]
+		case fields[0] == "require" && len(fields) >= 3:
+			mod.requires[fields[1]] = fields[2]
+		case fields[0] == "module" && len(fields) == 2:
+			mod.path = fields[1]
+		}
+	}
+	return mod
+}
+
+// validImportPath rejects import paths that could point outside of the
+// directory they are resolved in.
+func validImportPath(path string) bool {
+	if path == "" || strings.ContainsAny(path, `\:`) {
+		return false
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// within tells if path is root or below it.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	gas "github.com/HewlettPackard/gas/core"
+)
+
+// callRecorder records the types of all calls of package functions.
+type callRecorder struct {
+	types []string
+}
+
+func (r *callRecorder) Match(n ast.Node, c *gas.Context) (*gas.Issue, error) {
+	call := n.(*ast.CallExpr)
+	if _, ok := call.Fun.(*ast.SelectorExpr); ok {
+		if t := c.Info.Types[call].Type; t != nil && t != types.Typ[types.Invalid] {
+			r.types = append(r.types, t.String())
+		}
+	}
+	return nil, nil
+}
+
+func TestSourceImporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := filepath.Join(dir, "cache")
+	for name, content := range map[string]string{
+		"example.com/!cached@v1.0.0/go.mod":     "module example.com/Cached\n",
+		"example.com/!cached@v1.0.0/sub/sub.go": "package sub\ntype S struct{}\nfunc Make() S { return S{} }\n",
+		"outside/x.go":                          "package outside\nfunc X() int { return 0 }\n",
+	} {
+		path := filepath.Join(cache, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := buildTarball(t, "app", "", map[string]string{
+		"go.mod": "module example.com/app\n\nrequire (\n\texample.com/Cached v1.0.0 // indirect\n\texample.com/evil ../outside\n)\n",
+		"main.go": `package main
+
+import (
+	"example.com/Cached/sub"
+	"example.com/app/internal/store"
+	"example.com/evil"
+	"example.com/vendored"
+)
+
+var (
+	a = store.Open()
+	b = vendored.New()
+	c = sub.Make()
+	d = evil.X()
+)
+`,
+		"internal/store/store.go":          "package store\ntype DB struct{}\nfunc Open() *DB { return nil }\n",
+		"vendor/example.com/vendored/v.go": "package vendored\nimport \"example.com/app/internal/store\"\nfunc New() *store.DB { return nil }\n",
+	})
+	tree, err := extractArchive(context.Background(), bytes.NewReader(archive), filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := buildAnalyzer(defaultScanConfig())
+	a.importer = newSourceImporter(a.fset, tree, cache)
+	recorder := &callRecorder{}
+	a.addRule("", recorder, (*ast.CallExpr)(nil))
+
+	pkgs, err := a.parsePackages(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		if err := a.checkPackage(context.Background(), pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Vendored code is only type-checked, not analysed
+	if a.Stats.NumFiles != 2 {
+		t.Errorf("expected 2 files to be analysed, got %d", a.Stats.NumFiles)
+	}
+
+	sort.Strings(recorder.types)
+	expected := []string{"*example.com/app/internal/store.DB", "*example.com/app/internal/store.DB", "example.com/Cached/sub.S"}
+	if len(recorder.types) != len(expected) {
+		t.Fatalf("expected types %v, got %v", expected, recorder.types)
+	}
+	for i := range expected {
+		if recorder.types[i] != expected[i] {
+			t.Errorf("expected types %v, got %v", expected, recorder.types)
+		}
+	}
+}
+
+func TestParseGoMod(t *testing.T) {
+	mod := parseGoMod("", []byte(`// comment
+module "example.com/app"
+
+require example.com/a v1.0.0
+require (
+	example.com/b v0.1.0 // indirect
+)
+replace example.com/a => ../a
+`))
+
+	if mod.path != "example.com/app" {
+		t.Errorf("unexpected module path %q", mod.path)
+	}
+	if len(mod.requires) != 2 || mod.requires["example.com/a"] != "v1.0.0" || mod.requires["example.com/b"] != "v0.1.0" {
+		t.Errorf("unexpected requirements %v", mod.requires)
+	}
+
+	for path, valid := range map[string]bool{
+		"example.com/a": true,
+		"../etc":        false,
+		"a//b":          false,
+		"/etc":          false,
+		`a\..\..`:       false,
+	} {
+		if validImportPath(path) != valid {
+			t.Errorf("expected %s to be valid: %v", path, valid)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// An issue is a single finding of a scan. Issues are stored next to the
+// results document so they can be queried across repositories.
+type issue struct {
+	ScanID     int64  `json:"scan"`
+	Repo       string `json:"repo"`
+	Rule       string `json:"rule"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Severity   string `json:"severity"`
+	Confidence string `json:"confidence"`
+	Details    string `json:"details"`
+	Snippet    string `json:"code"`
+}
+
+// An issueFilter restricts issue queries. Empty fields match everything.
+// Queries only ever look at the most recent scan of each repository.
+type issueFilter struct {
+	Repo       string
+	Rule       string
+	Severity   string
+	Confidence string
+}
+
+// An issueCount is one row of an aggregated issue query.
+type issueCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// issueGroups maps the groupings accepted by countIssues to columns.
+var issueGroups = map[string]string{
+	"repo":       "repo",
+	"rule":       "rule",
+	"file":       "file",
+	"severity":   "severity",
+	"confidence": "confidence",
+}
+
+// where builds an SQL condition for the filter on the issues table aliased
+// as i. The placeholder function returns the placeholder for the n-th
+// argument.
+func (f issueFilter) where(placeholder func(n int) string) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+
+	add := func(column, value string) {
+		if value != "" {
+			args = append(args, value)
+			conds = append(conds, fmt.Sprintf("i.%s = %s", column, placeholder(len(args))))
+		}
+	}
+	add("repo", f.Repo)
+	add("rule", f.Rule)
+	add("severity", f.Severity)
+	add("confidence", f.Confidence)
+
+	return strings.Join(conds, " AND "), args
+}
+
+func (f issueFilter) matches(i *issue) bool {
+	return (f.Repo == "" || f.Repo == i.Repo) &&
+		(f.Rule == "" || f.Rule == i.Rule) &&
+		(f.Severity == "" || f.Severity == i.Severity) &&
+		(f.Confidence == "" || f.Confidence == i.Confidence)
+}
+
+func issueKey(i *issue, groupBy string) string {
+	switch groupBy {
+	case "repo":
+		return i.Repo
+	case "rule":
+		return i.Rule
+	case "file":
+		return i.File
+	case "severity":
+		return i.Severity
+	case "confidence":
+		return i.Confidence
+	}
+	return ""
+}
+
+func questionMark(int) string {
+	return "?"
+}
+
+func scanIssues(rows *sql.Rows) ([]*issue, error) {
+	defer rows.Close()
+
+	issues := []*issue{}
+	for rows.Next() {
+		i := &issue{}
+		err := rows.Scan(&i.ScanID, &i.Repo, &i.Rule, &i.File, &i.Line,
+			&i.Severity, &i.Confidence, &i.Details, &i.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, i)
+	}
+	return issues, rows.Err()
+}
+
+func scanIssueCounts(rows *sql.Rows) ([]*issueCount, error) {
+	defer rows.Close()
+
+	counts := []*issueCount{}
+	for rows.Next() {
+		c := &issueCount{}
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+func parseIssueFilter(req *http.Request) issueFilter {
+	q := req.URL.Query()
+	return issueFilter{
+		Repo:       q.Get("repo"),
+		Rule:       strings.ToUpper(q.Get("rule")),
+		Severity:   strings.ToUpper(q.Get("severity")),
+		Confidence: strings.ToUpper(q.Get("confidence")),
+	}
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		logError("unable to marshal response", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(raw)
+}
+
+// serveIssues lists current issues across all repositories, e.g.
+// /issues?rule=G401&severity=HIGH.
+func (w *worker) serveIssues(resp http.ResponseWriter, req *http.Request) {
+	filter := parseIssueFilter(req)
+
+	limit := issueLimit
+	if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 && l < issueLimit {
+		limit = l
+	}
+
+	issues, err := w.db.queryIssues(filter, limit)
+	if err != nil {
+		logError("unable to query issues", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(resp, map[string]interface{}{
+		"issues": issues,
+	})
+}
+
+// serveIssueSummary aggregates current issues across all repositories, e.g.
+// /issues/summary?by=repo&rule=G401 lists the repositories with G401
+// findings.
+func (w *worker) serveIssueSummary(resp http.ResponseWriter, req *http.Request) {
+	filter := parseIssueFilter(req)
+
+	groupBy := req.URL.Query().Get("by")
+	if groupBy == "" {
+		groupBy = "rule"
+	}
+	if _, ok := issueGroups[groupBy]; !ok {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	counts, err := w.db.countIssues(filter, groupBy)
+	if err != nil {
+		logError("unable to count issues", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(resp, map[string]interface{}{
+		"by":     groupBy,
+		"counts": counts,
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// janitorPath is the lock that makes sure only one node collects garbage
+// per interval. It can't clash with repository paths, which always start
+// with a host name.
+const janitorPath = "janitor"
+
+// A retention policy decides how long results are kept. A zero duration
+// keeps data forever.
+type retention struct {
+	// Results are dropped, with their whole history, once the repository
+	// has not been checked for this long. The same goes for private
+	// results, uploads are dropped once they are this old.
+	Results time.Duration
+
+	// History is the age after which scans that are no longer the most
+	// recent one of their repository are dropped.
+	History time.Duration
+}
+
+// A janitorReport counts the rows removed by one garbage collection run.
+type janitorReport struct {
+	Locks   int64
+	Results int64
+	Scans   int64
+	Issues  int64
+	Uploads int64
+	Private int64
+}
+
+type janitor struct {
+	db        database
+	interval  time.Duration
+	retention retention
+}
+
+// newJanitor reads the garbage collection settings from the environment.
+func newJanitor(db database) *janitor {
+	return &janitor{
+		db:       db,
+		interval: envDuration("JANITOR_INTERVAL", time.Hour),
+		retention: retention{
+			Results: envDuration("RESULTS_RETENTION", 90*24*time.Hour),
+			History: envDuration("HISTORY_RETENTION", 30*24*time.Hour),
+		},
+	}
+}
+
+func (j *janitor) run() {
+	if j.interval == 0 {
+		logger.Printf("janitor disabled")
+		return
+	}
+
+	nodeID := uuid.NewV4().String()
+	logger.Printf("running janitor %s every %s", nodeID, j.interval.String())
+
+	for {
+		if err := j.collect(nodeID); err != nil {
+			logError(fmt.Sprintf("node %s janitor error", nodeID), err)
+		}
+		time.Sleep(j.interval)
+	}
+}
+
+// collect removes garbage unless another node already did so during the
+// current interval. The janitor lock is not released, it simply expires
+// after one interval.
+func (j *janitor) collect(nodeID string) error {
+	lock, err := j.db.lockPath(nodeID, janitorPath, j.interval)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		logger.Printf("node %s skipping garbage collection, already done by another node", nodeID)
+		return nil
+	}
+
+	report, err := j.db.collectGarbage(time.Now(), j.retention)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("node %s collected garbage: %d expired locks, %d results, %d scans, %d issues, %d uploads, %d private results",
+		nodeID, report.Locks, report.Results, report.Scans, report.Issues, report.Uploads, report.Private)
+	return nil
+}
+
+// deleteGarbage implements collectGarbage for the SQL backends. Every
+// statement is idempotent, so concurrent runs are harmless.
+func deleteGarbage(db *sql.DB, placeholder func(n int) string, now time.Time, r retention) (*janitorReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	report := &janitorReport{}
+	exec := func(count *int64, query string, args ...interface{}) {
+		if err != nil {
+			return
+		}
+		var res sql.Result
+		res, err = tx.Exec(query, args...)
+		if err == nil {
+			*count, err = res.RowsAffected()
+		}
+	}
+
+	exec(&report.Locks, "DELETE FROM locks WHERE timestamp + lifetime < "+placeholder(1), now.Unix())
+	if r.Results > 0 {
+		cutoff := now.Add(-r.Results).Unix()
+		exec(&report.Scans, "DELETE FROM scans WHERE hash IN (SELECT hash FROM results WHERE timestamp < "+placeholder(1)+")", cutoff)
+		exec(&report.Results, "DELETE FROM results WHERE timestamp < "+placeholder(1), cutoff)
+		exec(&report.Uploads, "DELETE FROM uploads WHERE timestamp < "+placeholder(1), cutoff)
+		exec(&report.Private, "DELETE FROM private_results WHERE timestamp < "+placeholder(1), cutoff)
+	}
+	if r.History > 0 {
+		var superseded int64
+		exec(&superseded,
+			`DELETE FROM scans WHERE timestamp < `+placeholder(1)+`
+			 AND NOT EXISTS (SELECT 1 FROM results r WHERE r.scan_id = scans.id)`,
+			now.Add(-r.History).Unix())
+		report.Scans += superseded
+	}
+	exec(&report.Issues, "DELETE FROM issues WHERE NOT EXISTS (SELECT 1 FROM scans s WHERE s.id = issues.scan_id)")
+
+	if err != nil {
+		logError("error on rollback", tx.Rollback())
+		return nil, errors.WrapPrefix(err, "unable to collect garbage", 0)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to collect garbage", 0)
+	}
+	return report, nil
+}
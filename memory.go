@@ -0,0 +1,446 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// memoryDatabase keeps all state in process memory. It is meant for
+// development and unit tests, everything is lost on restart.
+type memoryDatabase struct {
+	mu      sync.Mutex
+	locks   map[string]*memoryLockEntry
+	results map[string]*memoryResult
+	scans   []*scan
+	issues  []*issue
+	uploads map[string]*upload
+	private map[string]*scan
+
+	// generation is the last lock generation handed out
+	generation int64
+}
+
+type memoryLockEntry struct {
+	holder     string
+	timestamp  time.Time
+	lifetime   time.Duration
+	generation int64
+}
+
+type memoryResult struct {
+	checked    time.Time
+	scan       *scan
+	generation int64
+}
+
+type memoryLock struct {
+	db         *memoryDatabase
+	lifetime   time.Duration
+	node       string
+	path       string
+	generation int64
+}
+
+func newMemoryDatabase() database {
+	return &memoryDatabase{
+		locks:   map[string]*memoryLockEntry{},
+		results: map[string]*memoryResult{},
+		uploads: map[string]*upload{},
+		private: map[string]*scan{},
+	}
+}
+
+func (db *memoryDatabase) lockPath(node, path string, lifetime time.Duration) (lock, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	logger.Printf("node %s requesting lock %s for %s", node, path, lifetime.String())
+
+	entry, ok := db.locks[path]
+	if ok && entry.holder != node && time.Now().Before(entry.timestamp.Add(entry.lifetime)) {
+		logger.Printf("node %s unable to acquire lock %s (already locked)", node, path)
+		return nil, nil
+	}
+
+	db.generation++
+	db.locks[path] = &memoryLockEntry{node, time.Now(), lifetime, db.generation}
+
+	logger.Printf("node %s acquired lock %s for %s (generation %d)", node, path, lifetime.String(), db.generation)
+	return &memoryLock{db, lifetime, node, path, db.generation}, nil
+}
+
+// checkFence fails with errStaleLock if the path was locked or written
+// under a newer generation than token. The caller must hold the lock.
+func (db *memoryDatabase) checkFence(path string, token int64) error {
+	if entry, ok := db.locks[path]; ok && entry.generation > token {
+		return errStaleLock
+	}
+	if r, ok := db.results[path]; ok && r.generation > token {
+		return errStaleLock
+	}
+	return nil
+}
+
+func (db *memoryDatabase) isLocked(path string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.locks[path]
+	if !ok {
+		return false, nil
+	}
+
+	return time.Now().Before(entry.timestamp.Add(entry.lifetime)), nil
+}
+
+func (ml *memoryLock) refresh() error {
+	ml.db.mu.Lock()
+	defer ml.db.mu.Unlock()
+
+	logger.Printf("node %s refreshing lock %s for %s", ml.node, ml.path, ml.lifetime.String())
+
+	entry, ok := ml.db.locks[ml.path]
+	if !ok || entry.holder != ml.node {
+		logger.Printf("node %s unable to refresh lock %s (lost lock)", ml.node, ml.path)
+		return errors.New("unable to refresh lock: lost lock?")
+	}
+
+	entry.timestamp = time.Now()
+	entry.lifetime = ml.lifetime
+	return nil
+}
+
+func (ml *memoryLock) token() int64 {
+	return ml.generation
+}
+
+func (ml *memoryLock) unlock() error {
+	ml.db.mu.Lock()
+	defer ml.db.mu.Unlock()
+
+	logger.Printf("node %s dropping lock %s", ml.node, ml.path)
+
+	if entry, ok := ml.db.locks[ml.path]; ok && entry.holder == ml.node {
+		delete(ml.db.locks, ml.path)
+	}
+	return nil
+}
+
+func (db *memoryDatabase) storeResults(s *scan, token int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkFence(s.Path, token); err != nil {
+		return err
+	}
+
+	stored := *s
+	stored.ID = int64(len(db.scans) + 1)
+	stored.Timestamp = time.Now()
+	stored.Checked = time.Time{}
+	stored.Issues = nil
+	db.scans = append(db.scans, &stored)
+	for _, i := range s.Issues {
+		i := *i
+		i.ScanID = stored.ID
+		i.Repo = s.Path
+		db.issues = append(db.issues, &i)
+	}
+	db.results[s.Path] = &memoryResult{stored.Timestamp, &stored, token}
+
+	s.ID = stored.ID
+	s.Timestamp = stored.Timestamp
+	s.Checked = stored.Timestamp
+	return nil
+}
+
+func (db *memoryDatabase) fetchResults(path string) (*scan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, ok := db.results[path]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	s := *r.scan
+	s.Checked = r.checked
+	return &s, nil
+}
+
+func (db *memoryDatabase) updateTimestamp(path string, token int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkFence(path, token); err != nil {
+		return err
+	}
+
+	if r, ok := db.results[path]; ok {
+		r.checked = time.Now()
+		r.generation = token
+	}
+	return nil
+}
+
+func (db *memoryDatabase) listScans(path string, limit int) ([]*scan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	scans := []*scan{}
+	for i := len(db.scans) - 1; i >= 0 && len(scans) < limit; i-- {
+		if db.scans[i] != nil && db.scans[i].Path == path {
+			s := *db.scans[i]
+			s.Results = nil
+			scans = append(scans, &s)
+		}
+	}
+	return scans, nil
+}
+
+func (db *memoryDatabase) fetchScan(path string, id int64) (*scan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if id < 1 || id > int64(len(db.scans)) || db.scans[id-1] == nil || db.scans[id-1].Path != path {
+		return nil, sql.ErrNoRows
+	}
+
+	s := *db.scans[id-1]
+	return &s, nil
+}
+
+func (db *memoryDatabase) findScanByCommit(commit, ruleSet string) (*scan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := len(db.scans) - 1; i >= 0; i-- {
+		s := db.scans[i]
+		if s == nil || s.Commit != commit || s.RuleSet != ruleSet || s.Missing || s.Path == "" {
+			continue
+		}
+
+		found := *s
+		found.Issues = []*issue{}
+		for _, i := range db.issues {
+			if i.ScanID == s.ID {
+				issue := *i
+				found.Issues = append(found.Issues, &issue)
+			}
+		}
+		return &found, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// currentIssues returns the issues of the most recent scans matching f.
+// The caller must hold the lock.
+func (db *memoryDatabase) currentIssues(f issueFilter) []*issue {
+	latest := map[int64]bool{}
+	for _, r := range db.results {
+		latest[r.scan.ID] = true
+	}
+
+	issues := []*issue{}
+	for _, i := range db.issues {
+		if latest[i.ScanID] && f.matches(i) {
+			issue := *i
+			issues = append(issues, &issue)
+		}
+	}
+	return issues
+}
+
+func (db *memoryDatabase) queryIssues(f issueFilter, limit int) ([]*issue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	issues := db.currentIssues(f)
+	sort.Sort(issuesByLocation(issues))
+	if len(issues) > limit {
+		issues = issues[:limit]
+	}
+	return issues, nil
+}
+
+func (db *memoryDatabase) countIssues(f issueFilter, groupBy string) ([]*issueCount, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := issueGroups[groupBy]; !ok {
+		return nil, errors.Errorf("unable to count issues: invalid grouping %s", groupBy)
+	}
+
+	byKey := map[string]*issueCount{}
+	counts := []*issueCount{}
+	for _, i := range db.currentIssues(f) {
+		key := issueKey(i, groupBy)
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = &issueCount{Key: key}
+			counts = append(counts, byKey[key])
+		}
+		byKey[key].Count++
+	}
+
+	sort.Sort(issueCountsByCount(counts))
+	return counts, nil
+}
+
+func (db *memoryDatabase) storeUpload(u *upload) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.uploads[u.ID]; ok {
+		return errors.Errorf("unable to store upload: duplicate ID %s", u.ID)
+	}
+	stored := *u
+	db.uploads[u.ID] = &stored
+	return nil
+}
+
+func (db *memoryDatabase) fetchUpload(id string) (*upload, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.uploads[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *u
+	return &found, nil
+}
+
+func (db *memoryDatabase) storePrivateResults(s *scan) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored := *s
+	stored.Timestamp = time.Now()
+	stored.Checked = stored.Timestamp
+	stored.Issues = nil
+	db.private[s.Path] = &stored
+
+	s.Timestamp = stored.Timestamp
+	s.Checked = stored.Checked
+	return nil
+}
+
+func (db *memoryDatabase) fetchPrivateResults(path string) (*scan, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.private[path]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *s
+	return &found, nil
+}
+
+func (db *memoryDatabase) collectGarbage(now time.Time, r retention) (*janitorReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	report := &janitorReport{}
+	for path, entry := range db.locks {
+		if entry.timestamp.Add(entry.lifetime).Before(now) {
+			delete(db.locks, path)
+			report.Locks++
+		}
+	}
+
+	latest := map[int64]bool{}
+	for path, result := range db.results {
+		if r.Results > 0 && result.checked.Before(now.Add(-r.Results)) {
+			delete(db.results, path)
+			report.Results++
+			continue
+		}
+		latest[result.scan.ID] = true
+	}
+
+	// Scan IDs are indices into db.scans, so dropped scans are set to nil
+	// instead of being removed.
+	kept := map[int64]bool{}
+	for i, s := range db.scans {
+		if s == nil {
+			continue
+		}
+		_, current := db.results[s.Path]
+		expired := !current && r.Results > 0
+		superseded := !latest[s.ID] && r.History > 0 && s.Timestamp.Before(now.Add(-r.History))
+		if expired || superseded {
+			db.scans[i] = nil
+			report.Scans++
+			continue
+		}
+		kept[s.ID] = true
+	}
+
+	issues := []*issue{}
+	for _, i := range db.issues {
+		if kept[i.ScanID] {
+			issues = append(issues, i)
+		}
+	}
+	report.Issues = int64(len(db.issues) - len(issues))
+	db.issues = issues
+
+	for path, s := range db.private {
+		if r.Results > 0 && s.Checked.Before(now.Add(-r.Results)) {
+			delete(db.private, path)
+			report.Private++
+		}
+	}
+
+	for id, u := range db.uploads {
+		if r.Results > 0 && u.Timestamp.Before(now.Add(-r.Results)) {
+			delete(db.uploads, id)
+			report.Uploads++
+		}
+	}
+
+	return report, nil
+}
+
+type issuesByLocation []*issue
+
+func (s issuesByLocation) Len() int      { return len(s) }
+func (s issuesByLocation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s issuesByLocation) Less(i, j int) bool {
+	if s[i].Repo != s[j].Repo {
+		return s[i].Repo < s[j].Repo
+	}
+	if s[i].File != s[j].File {
+		return s[i].File < s[j].File
+	}
+	return s[i].Line < s[j].Line
+}
+
+type issueCountsByCount []*issueCount
+
+func (s issueCountsByCount) Len() int      { return len(s) }
+func (s issueCountsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s issueCountsByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Key < s[j].Key
+}
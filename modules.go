@@ -0,0 +1,193 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/go-errors/errors"
+)
+
+// pseudoVersion matches versions made up for untagged commits, e.g.
+// v0.0.0-20161107132208-0123456789ab, capturing the abbreviated commit.
+var pseudoVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+-(?:.*[.-])?[0-9]{14}-([0-9a-f]{12})(?:\+incompatible)?$`)
+
+// moduleProxy downloads Go modules from a module proxy, e.g.
+// https://proxy.golang.org. Module versions are immutable, so a version is
+// never scanned twice with the same rules. Modules are named by their
+// module path and pinned to a version, branch or commit with "@", the
+// latest version is scanned otherwise.
+type moduleProxy struct {
+	base   string
+	client *http.Client
+}
+
+// newModuleProxy sets up the proxy at base, which may also be a file://
+// URL to serve modules from a directory laid out like a proxy.
+func newModuleProxy(base string) (*moduleProxy, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+		return nil, errors.Errorf("unsupported module proxy %s", base)
+	}
+
+	// Files are only served from the directory of a file:// proxy, which
+	// then becomes the root of all URLs
+	base = strings.TrimSuffix(base, "/")
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if u.Scheme == "file" {
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(filepath.FromSlash(u.Path))))
+		base = "file://"
+	}
+
+	return &moduleProxy{
+		base: base,
+		client: &http.Client{
+			Transport:     transport,
+			CheckRedirect: sameSchemeRedirect,
+		},
+	}, nil
+}
+
+// sameSchemeRedirect follows redirects like the default policy of an HTTP
+// client, but never from one scheme to another.
+func sameSchemeRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != via[0].URL.Scheme {
+		return errors.Errorf("refusing redirect from %s to %s", via[0].URL.Scheme, req.URL.Scheme)
+	}
+	return nil
+}
+
+// moduleProxyURL picks the first proxy from a GOPROXY list. The "direct"
+// and "off" keywords only mean something to the go command.
+func moduleProxyURL(list string) string {
+	for _, entry := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '|' }) {
+		if entry != "direct" && entry != "off" {
+			return entry
+		}
+	}
+	return "https://proxy.golang.org"
+}
+
+// escapeModulePath encodes upper-case letters as "!" followed by the lower
+// case letter, as the proxy protocol demands for case-insensitive file
+// systems.
+func escapeModulePath(path string) string {
+	var buf bytes.Buffer
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			buf.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func (h *moduleProxy) name() string {
+	return "mod"
+}
+
+func (h *moduleProxy) pattern() string {
+	return repoName + "(?:/" + repoName + ")*"
+}
+
+// revision resolves ref to a module version with its .info file. The
+// version is the ETag, so a module is only scanned again once a new
+// version is released.
+func (h *moduleProxy) revision(ctx context.Context, repo, ref, etag string) (*revision, error) {
+	url := h.base + "/" + escapeModulePath(repo) + "/@latest"
+	if ref != "" {
+		url = h.base + "/" + escapeModulePath(repo) + "/@v/" + escapeModulePath(ref) + ".info"
+	}
+
+	res, err := getWith(ctx, h.client, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var info struct {
+		Version string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to read module info", 0)
+	}
+	if info.Version == "" {
+		return nil, errors.Errorf("unable to read module info of %s@%s", repo, ref)
+	}
+
+	rev := &revision{ETag: `"` + info.Version + `"`, Ref: info.Version}
+	if rev.ETag == etag {
+		return nil, errNotModified
+	}
+	return rev, nil
+}
+
+// fetch downloads the module zip. All files in it are below
+// "{module}@{version}/", the tree is rooted there.
+func (h *moduleProxy) fetch(ctx context.Context, repo string, rev *revision, dir string) (*sourceTree, error) {
+	url := h.base + "/" + escapeModulePath(repo) + "/@v/" + escapeModulePath(rev.Ref) + ".zip"
+	res, err := getWith(ctx, h.client, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	tree, err := extractArchive(ctx, res.Body, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	root := filepath.Join(dir, filepath.FromSlash(repo+"@"+rev.Ref))
+
+	// Module zips don't record commits, except in pseudo-versions
+	abbrev := ""
+	if m := pseudoVersion.FindStringSubmatch(rev.Ref); m != nil {
+		abbrev = m[1]
+	}
+	return &sourceTree{
+		dir:        root,
+		files:      reroot(tree.dir, root, tree.files),
+		tests:      reroot(tree.dir, root, tree.tests),
+		abbrev:     abbrev,
+		importPath: repo,
+	}, nil
+}
+
+// reroot makes files relative to dir relative to root, dropping those that
+// are outside of it.
+func reroot(dir, root string, files []string) []string {
+	rel := []string{}
+	for _, name := range files {
+		r, err := filepath.Rel(root, filepath.Join(dir, name))
+		if err == nil && !strings.HasPrefix(r, "..") {
+			rel = append(rel, r)
+		}
+	}
+	return rel
+}
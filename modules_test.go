@@ -0,0 +1,130 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModule stores a module version in a directory laid out like a
+// module proxy.
+func writeModule(t *testing.T, proxy, module, version string, files map[string]string) {
+	dir := filepath.Join(proxy, filepath.FromSlash(escapeModulePath(module)), "@v")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	info := []byte(`{"Version":"` + version + `","Time":"2016-11-07T13:22:08Z"}`)
+	archive := buildZip(t, module+"@"+version, "", files)
+	for name, content := range map[string][]byte{
+		filepath.Join(dir, escapeModulePath(version)+".info"): info,
+		filepath.Join(dir, escapeModulePath(version)+".zip"):  archive,
+		filepath.Join(dir, "..", "@latest"):                   info,
+	} {
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWorkerModule(t *testing.T) {
+	proxy, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proxy)
+
+	pseudo := "v0.0.0-20161107132208-0123456789ab"
+	writeModule(t, proxy, "example.com/User/module", "v1.0.0", testSources)
+	writeModule(t, proxy, "example.com/User/module", pseudo, testSources)
+
+	h, err := newModuleProxy("file://" + filepath.ToSlash(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWorker(map[string]host{"mod": h})
+
+	for path, commit := range map[string]string{
+		"mod/example.com/User/module@v1.0.0":    "",
+		"mod/example.com/User/module@" + pseudo: "0123456789ab",
+	} {
+		if err := w.process("node", path); err != nil {
+			t.Fatalf("unable to process %s: %v", path, err)
+		}
+		checkScan(t, w.db, path, commit)
+	}
+
+	// The latest version is scanned without a version, and only once
+	if _, err := w.analyze(context.Background(), "node", "mod/example.com/User/module", `"`+pseudo+`"`); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+
+	if err := w.process("node", "mod/example.com/User/module@v2.0.0"); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+}
+
+func TestModuleProxyURL(t *testing.T) {
+	for list, expected := range map[string]string{
+		"":                                "https://proxy.golang.org",
+		"direct":                          "https://proxy.golang.org",
+		"https://athens.local,direct":     "https://athens.local",
+		"off|file:///srv/proxy":           "file:///srv/proxy",
+		"direct,https://proxy.golang.org": "https://proxy.golang.org",
+	} {
+		if actual := moduleProxyURL(list); actual != expected {
+			t.Errorf("expected %s for %q, got %s", expected, list, actual)
+		}
+	}
+
+	if _, err := newModuleProxy("ftp://example.com"); err == nil {
+		t.Error("expected unsupported scheme to be rejected")
+	}
+	if escaped := escapeModulePath("github.com/Azure/go-autorest"); escaped != "github.com/!azure/go-autorest" {
+		t.Errorf("unexpected escaped path %s", escaped)
+	}
+}
+
+func TestModuleProxyRedirect(t *testing.T) {
+	proxy, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proxy)
+	writeModule(t, proxy, "example.com/module", "v1.0.0", testSources)
+
+	// Proxies must not send the service to files on disk
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, "file://"+filepath.ToSlash(proxy)+req.URL.Path, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	h, _ := newModuleProxy(srv.URL)
+	if _, err := h.revision(context.Background(), "example.com/module", "v1.0.0", ""); err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+		t.Fatalf("expected redirect to be refused, got %v", err)
+	}
+
+	// Directory proxies only serve files below their directory
+	h, _ = newModuleProxy("file://" + filepath.ToSlash(filepath.Join(proxy, "example.com")))
+	if _, err := h.revision(context.Background(), "../example.com/module", "v1.0.0", ""); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+	"github.com/go-errors/errors"
+	_ "github.com/lib/pq"
+)
+
+// postgresDialect reads locked rows with FOR UPDATE. That doesn't keep two
+// nodes from inserting the same new lock, the loser ignores the conflict
+// and doesn't get the lock.
+var postgresDialect = &sqlDialect{
+	placeholder:     dollar,
+	forUpdate:       " FOR UPDATE",
+	emptyBlob:       "''::bytea",
+	upsert:          upsertExcluded,
+	ignoreDuplicate: " ON CONFLICT (hash) DO NOTHING",
+	returning:       true,
+	migrations:      "db/postgres",
+	driver: goose.DBDriver{
+		Name:    "postgres",
+		Import:  "github.com/lib/pq",
+		Dialect: &goose.PostgresDialect{},
+	},
+}
+
+func newPostgresDatabase(url string) (database, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to talk to DB", 0)
+	}
+
+	return &sqlDatabase{db, postgresDialect}, nil
+}
+
+// dollar returns the n-th positional placeholder.
+func dollar(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
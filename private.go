@@ -0,0 +1,253 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// accessLifetime is how long the access of a user to a private repository
+// is remembered before it is checked with GitHub again.
+const accessLifetime = 5 * time.Minute
+
+// accessCheck is the remembered outcome of a check whether a repository is
+// private and readable by a user.
+type accessCheck struct {
+	private bool
+	expires time.Time
+}
+
+// servePrivateResults serves the results of a private GitHub repository
+// if the request comes from a signed in user who can read it. It returns
+// false if the repository is public or unknown to the user, the request is
+// then served from the public results instead.
+//
+// Private repositories are scanned right away with the user's token, by at
+// most one request per repository and at most len(w.private) requests at a
+// time. Their results are stored apart from public ones, without history or
+// issues, and access is checked with GitHub every accessLifetime.
+func (w *worker) servePrivateResults(resp http.ResponseWriter, req *http.Request, path string) bool {
+	s := w.sessions.read(req)
+	if s == nil {
+		return false
+	}
+	h, repo, err := hostRepo(w.hosts, path)
+	if err != nil {
+		return false
+	}
+	github, ok := h.(*githubHost)
+	if !ok {
+		return false
+	}
+	repo, _ = splitRef(repo)
+
+	user := github.withToken(s.Token)
+	private, err := w.isPrivate(req.Context(), s.Login, user, repo)
+	if err == errNotFound || (err == nil && !private) {
+		return false
+	} else if err != nil {
+		logError(fmt.Sprintf("unable to check access of %s to %s", s.Login, path), err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return true
+	}
+
+	prev, err := w.db.fetchPrivateResults(path)
+	if err != nil && err != sql.ErrNoRows {
+		logError(fmt.Sprintf("unable to fetch private results for path %s", path), err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	if prev != nil && time.Now().Before(prev.Checked.Add(1*time.Hour)) {
+		writePrivateResults(resp, req, prev)
+		return true
+	}
+
+	// Private paths are locked apart from public ones, which are recorded
+	// as missing by the worker
+	nodeID := uuid.NewV4().String()
+	lock, err := w.db.lockPath(nodeID, "private/"+path, w.lockLifetime)
+	if err != nil {
+		logError(fmt.Sprintf("unable to lock private repository %s", path), err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	if lock == nil {
+		w.waitPrivateResults(resp, req, path, prev)
+		return true
+	}
+	defer lock.unlock()
+
+	select {
+	case w.private <- struct{}{}:
+		defer func() { <-w.private }()
+	default:
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+
+	etag := ""
+	if prev != nil && prev.RuleSet == ruleSetVersion() {
+		etag = prev.ETag
+	}
+
+	logger.Printf("%s requesting scan of private repository %s", s, path)
+	hb := startHeartbeat(req.Context(), lock, w.lockRefresh)
+	scanned, err := w.analyzeWith(hb.ctx, nodeID, user, path, etag)
+	if lost := hb.stop(); lost != nil {
+		err = lost
+	}
+	if err == errNotModified {
+		scanned = prev
+	} else if err == errNotFound {
+		resp.WriteHeader(http.StatusNotFound)
+		return true
+	} else if err != nil {
+		logError(fmt.Sprintf("unable to process private repository %s", path), err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return true
+	}
+
+	if err := w.db.storePrivateResults(scanned); err != nil {
+		logError("unable to store private results", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	writePrivateResults(resp, req, scanned)
+	return true
+}
+
+// isPrivate tells if a repository is private and readable by the user
+// with the given login, remembering the answer for accessLifetime.
+func (w *worker) isPrivate(ctx context.Context, login string, user *githubHost, repo string) (bool, error) {
+	key := login + "/" + repo
+	now := time.Now()
+
+	w.mu.Lock()
+	check, ok := w.access[key]
+	w.mu.Unlock()
+	if ok && now.Before(check.expires) {
+		return check.private, nil
+	}
+
+	private, err := user.isPrivate(ctx, repo)
+	if err != nil && err != errNotFound {
+		return false, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, c := range w.access {
+		if now.After(c.expires) {
+			delete(w.access, k)
+		}
+	}
+	w.access[key] = accessCheck{private, now.Add(accessLifetime)}
+	return private, err
+}
+
+// waitPrivateResults waits for at most 20 seconds for another request to
+// finish scanning a private repository.
+func (w *worker) waitPrivateResults(resp http.ResponseWriter, req *http.Request, path string, prev *scan) {
+	for i := 0; i < 20; i++ {
+		s, err := w.db.fetchPrivateResults(path)
+		if err != nil && err != sql.ErrNoRows {
+			logError(fmt.Sprintf("unable to fetch private results for path %s", path), err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err == sql.ErrNoRows || (prev != nil && prev.Checked.Equal(s.Checked)) {
+			// No new results yet
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+
+		writePrivateResults(resp, req, s)
+		return
+	}
+
+	resp.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// writePrivateResults writes results that must not end up in any shared
+// cache.
+func writePrivateResults(resp http.ResponseWriter, req *http.Request, s *scan) {
+	resp.Header().Set("Cache-Control", "private, no-store")
+	resp.Header().Add("Vary", "Cookie")
+	writeDocument(resp, req, s.Results)
+}
+
+// replacePrivateResults implements storePrivateResults for the SQL
+// backends. Only the most recent results of each path are kept.
+func replacePrivateResults(db *sql.DB, placeholder func(n int) string, s *scan) error {
+	hash := sha256.Sum256([]byte(s.Path))
+	now := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM private_results WHERE hash = "+placeholder(1), hash[:])
+	if err == nil {
+		_, err = tx.Exec(
+			`INSERT INTO private_results (hash, path, timestamp, etag, commit_id, ruleset, results)
+			 VALUES (`+placeholder(1)+`, `+placeholder(2)+`, `+placeholder(3)+`, `+placeholder(4)+`, `+
+				placeholder(5)+`, `+placeholder(6)+`, `+placeholder(7)+`)`,
+			hash[:], s.Path, now.Unix(), s.ETag, s.Commit, s.RuleSet, s.storedResults())
+	}
+	if err != nil {
+		logError("error on rollback", tx.Rollback())
+		return errors.WrapPrefix(err, "unable to store private results", 0)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.WrapPrefix(err, "unable to store private results", 0)
+	}
+	s.Timestamp = time.Unix(now.Unix(), 0)
+	s.Checked = s.Timestamp
+	return nil
+}
+
+// selectPrivateResults implements fetchPrivateResults for the SQL backends.
+func selectPrivateResults(db *sql.DB, placeholder func(n int) string, path string) (*scan, error) {
+	hash := sha256.Sum256([]byte(path))
+	r := db.QueryRow(
+		`SELECT timestamp, etag, commit_id, ruleset, results FROM private_results
+		 WHERE hash = `+placeholder(1), hash[:])
+
+	var timestamp int64
+	s := &scan{Path: path}
+	err := r.Scan(&timestamp, &s.ETag, &s.Commit, &s.RuleSet, &s.Results)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	s.Timestamp = time.Unix(timestamp, 0)
+	s.Checked = s.Timestamp
+	return s, nil
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// A rateLimit is the API budget of a single token, as last reported by the
+// API. Limit and Remaining are -1 until the first response was seen.
+type rateLimit struct {
+	Authenticated bool      `json:"authenticated"`
+	Limit         int       `json:"limit"`
+	Remaining     int       `json:"remaining"`
+	Reset         time.Time `json:"reset"`
+}
+
+type apiToken struct {
+	value string
+	rateLimit
+}
+
+// available tells if the token may be used at the given time.
+func (t *apiToken) available(now time.Time) bool {
+	return t.Remaining != 0 || !now.Before(t.Reset)
+}
+
+// A tokenPool spreads API requests over a set of tokens, always picking the
+// one with the most remaining budget.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []*apiToken
+}
+
+// newTokenPool creates a pool of the given tokens. Without tokens, requests
+// are made unauthenticated.
+func newTokenPool(values []string) *tokenPool {
+	p := &tokenPool{}
+	for _, v := range values {
+		if v != "" {
+			p.tokens = append(p.tokens, &apiToken{v, rateLimit{true, -1, -1, time.Time{}}})
+		}
+	}
+	if len(p.tokens) == 0 {
+		p.tokens = []*apiToken{{"", rateLimit{false, -1, -1, time.Time{}}}}
+	}
+	return p
+}
+
+// acquire picks a token with budget left. If there is none, it returns
+// nil and how long until the first token is renewed.
+func (p *tokenPool) acquire() (*apiToken, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *apiToken
+	for _, t := range p.tokens {
+		if !t.available(now) {
+			continue
+		}
+		if best == nil || best.Remaining >= 0 && (t.Remaining < 0 || t.Remaining > best.Remaining) {
+			best = t
+		}
+	}
+	if best != nil {
+		if best.Remaining > 0 {
+			// Reserve budget for the request, the response corrects it
+			best.Remaining--
+		}
+		return best, 0
+	}
+	return nil, p.wait(now)
+}
+
+// wait returns how long until a token has budget. The caller must hold
+// the lock.
+func (p *tokenPool) wait(now time.Time) time.Duration {
+	var wait time.Duration
+	for i, t := range p.tokens {
+		if t.available(now) {
+			return 0
+		}
+		if d := t.Reset.Sub(now); i == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// throttled returns how long until the pool has budget again, or zero if
+// requests can be made right away.
+func (p *tokenPool) throttled() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.wait(time.Now())
+}
+
+// update records the budget reported in the headers of a response made
+// with t. Secondary rate limits only send a Retry-After header.
+func (p *tokenPool) update(t *apiToken, res *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limit, err1 := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 == nil && err2 == nil && err3 == nil {
+		t.Limit = limit
+		t.Remaining = remaining
+		t.Reset = time.Unix(reset, 0)
+	}
+
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests {
+		if retry, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			t.Remaining = 0
+			t.Reset = time.Now().Add(time.Duration(retry) * time.Second)
+		}
+	}
+}
+
+// budget returns the current rate limits of all tokens in the pool.
+func (p *tokenPool) budget() []rateLimit {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limits := []rateLimit{}
+	for _, t := range p.tokens {
+		limits = append(limits, t.rateLimit)
+	}
+	return limits
+}
+
+// rateLimitTransport authenticates requests to an API host with tokens from
+// a pool and tracks their budget. Requests to other hosts, e.g. archive
+// downloads after a redirect, are passed through untouched.
+type rateLimitTransport struct {
+	host string
+	pool *tokenPool
+	base http.RoundTripper
+}
+
+func (rt *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != rt.host {
+		return rt.base.RoundTrip(req)
+	}
+
+	t, _ := rt.pool.acquire()
+	if t == nil {
+		return nil, errRateLimited
+	}
+
+	if t.value != "" {
+		r := new(http.Request)
+		*r = *req
+		r.Header = http.Header{}
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Authorization", "token "+t.value)
+		req = r
+	}
+
+	res, err := rt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rt.pool.update(t, res)
+	return res, nil
+}
+
+// serveRateLimits shows the API budget of all hosts that have one.
+func (w *worker) serveRateLimits(resp http.ResponseWriter, req *http.Request) {
+	limits := map[string][]rateLimit{}
+	for name, h := range w.hosts {
+		if h, ok := h.(throttledHost); ok {
+			limits[name] = h.rateLimits()
+		}
+	}
+
+	writeJSON(resp, map[string]interface{}{
+		"limits": limits,
+	})
+}
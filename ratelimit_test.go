@@ -0,0 +1,174 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenPool(t *testing.T) {
+	p := newTokenPool([]string{"a", "b"})
+	reset := time.Now().Add(time.Hour)
+
+	a, _ := p.acquire()
+	p.update(a, rateLimitResponse(http.StatusOK, 5000, 10, reset))
+	b, _ := p.acquire()
+	if b == a {
+		t.Fatal("expected unused token to be picked first")
+	}
+	p.update(b, rateLimitResponse(http.StatusOK, 5000, 20, reset))
+
+	if next, _ := p.acquire(); next != b {
+		t.Fatalf("expected token with most budget, got %s", next.value)
+	}
+
+	p.update(a, rateLimitResponse(http.StatusOK, 5000, 0, reset))
+	p.update(b, rateLimitResponse(http.StatusForbidden, 5000, 0, reset))
+	if none, wait := p.acquire(); none != nil || wait <= 0 || wait > time.Hour {
+		t.Fatalf("expected pool to be exhausted, got %v and %s", none, wait)
+	}
+	if p.throttled() <= 0 {
+		t.Fatal("expected pool to be throttled")
+	}
+
+	// Budgets are renewed once the reset time passed
+	p.update(a, rateLimitResponse(http.StatusOK, 5000, 0, time.Now().Add(-time.Second)))
+	if next, wait := p.acquire(); next != a || wait != 0 {
+		t.Fatalf("expected renewed token, got %v and %s", next, wait)
+	}
+
+	for _, l := range p.budget() {
+		if !l.Authenticated || l.Limit != 5000 {
+			t.Fatalf("unexpected budget %+v", l)
+		}
+	}
+}
+
+func TestTokenPoolRetryAfter(t *testing.T) {
+	p := newTokenPool(nil)
+
+	tok, _ := p.acquire()
+	if tok == nil || tok.value != "" || tok.Authenticated {
+		t.Fatalf("expected unauthenticated token, got %+v", tok)
+	}
+
+	res := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"Retry-After": {"60"}}}
+	p.update(tok, res)
+	if wait := p.throttled(); wait <= 0 || wait > time.Minute {
+		t.Fatalf("expected to wait for secondary rate limit, got %s", wait)
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var mu sync.Mutex
+	seen := []string{}
+	reset := time.Now().Add(time.Hour)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		seen = append(seen, req.Header.Get("Authorization"))
+		mu.Unlock()
+
+		resp.Header().Set("X-RateLimit-Limit", "5000")
+		resp.Header().Set("X-RateLimit-Remaining", "0")
+		resp.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset.Unix()))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	pool := newTokenPool([]string{"secret"})
+	client := &http.Client{Transport: &rateLimitTransport{u.Host, pool, http.DefaultTransport}}
+
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.Body.Close()
+
+	if len(seen) != 1 || seen[0] != "token secret" {
+		t.Fatalf("expected authenticated request, got %v", seen)
+	}
+
+	if _, err := client.Get(srv.URL); err == nil || !strings.Contains(err.Error(), errRateLimited.Error()) {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if len(seen) != 1 {
+		t.Fatal("request sent despite exhausted budget")
+	}
+}
+
+// throttledStub is a host that is out of budget for some time.
+type throttledStub struct {
+	host
+	wait time.Duration
+}
+
+func (h *throttledStub) name() string {
+	return "example.com"
+}
+
+func (h *throttledStub) throttled() time.Duration {
+	return h.wait
+}
+
+func (h *throttledStub) rateLimits() []rateLimit {
+	return nil
+}
+
+func TestHoldQueueFull(t *testing.T) {
+	w := newTestWorker(map[string]host{"example.com": &throttledStub{wait: time.Millisecond}})
+	w.reqs = make(chan string, 1)
+	w.reqs <- "example.com/busy/queue"
+
+	for i := 0; i < 10; i++ {
+		if !w.hold("node", fmt.Sprintf("example.com/user/repo%d", i)) {
+			t.Fatal("expected request to be held")
+		}
+	}
+
+	// Released requests are dropped instead of waiting for room in the queue
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		held := len(w.held)
+		w.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests still held", held)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(w.reqs) != 1 || <-w.reqs != "example.com/busy/queue" {
+		t.Fatal("unexpected queued requests")
+	}
+}
+
+func rateLimitResponse(status, limit, remaining int, reset time.Time) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header: http.Header{
+			"X-Ratelimit-Limit":     {fmt.Sprint(limit)},
+			"X-Ratelimit-Remaining": {fmt.Sprint(remaining)},
+			"X-Ratelimit-Reset":     {fmt.Sprint(reset.Unix())},
+		},
+	}
+}
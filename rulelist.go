@@ -17,10 +17,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"go/ast"
+	"net/url"
+	"sort"
+	"strings"
 
 	gas "github.com/HewlettPackard/gas/core"
 	"github.com/HewlettPackard/gas/rules"
+	"github.com/go-errors/errors"
 )
 
 type ruleInfo struct {
@@ -33,7 +39,7 @@ var allRules = map[string]ruleInfo{
 	"G101": ruleInfo{"Look for hardcoded credentials", rules.NewHardcodedCredentials},
 	"G102": ruleInfo{"Bind to all interfaces", rules.NewBindsToAllNetworkInterfaces},
 	"G103": ruleInfo{"Audit the use of unsafe block", rules.NewUsingUnsafe},
-	"G104": ruleInfo{"Audit errors not checked", rules.NewTemplateCheck},
+	"G104": ruleInfo{"Audit errors not checked", rules.NewNoErrorCheck},
 
 	// injection
 	"G201": ruleInfo{"SQL query construction using format string", rules.NewSqlStrFormat},
@@ -59,8 +65,80 @@ var allRules = map[string]ruleInfo{
 	"G504": ruleInfo{"Import blacklist: net/http/cgi", rules.NewBlacklist_net_http_cgi},
 }
 
-func addRules(analyzer *gas.Analyzer, conf map[string]interface{}) {
-	for _, v := range allRules {
-		analyzer.AddRule(v.build(conf))
+func addRules(analyzer *analyzer, conf map[string]interface{}) {
+	for id, v := range allRules {
+		if !analyzer.Config.rules.enabled(id) {
+			continue
+		}
+		rule, node := v.build(conf)
+		analyzer.addRule(id, rule, node)
 	}
 }
+
+// rulesRevision is bumped when the findings of rules or the documents they
+// end up in change, without any rule being added, removed or renamed.
+const rulesRevision = "5"
+
+// ruleSetVersion identifies the enabled rule set, so that results produced
+// with different rules can be told apart.
+func ruleSetVersion() string {
+	ids := make([]string, 0, len(allRules)+1)
+	ids = append(ids, "revision:"+rulesRevision)
+	for id, v := range allRules {
+		ids = append(ids, id+":"+v.description)
+	}
+	sort.Strings(ids)
+
+	hash := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// A ruleSelection restricts results to some rules, e.g. for
+// ?include=G101,G201&exclude=G104. Scans always run all rules, selections
+// only filter their results, so one scan serves every selection.
+type ruleSelection struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+// parseRuleSelection reads the include and exclude query parameters, both
+// comma-separated lists of rule IDs. It returns nil if neither is given.
+func parseRuleSelection(query url.Values) (*ruleSelection, error) {
+	if query.Get("include") == "" && query.Get("exclude") == "" {
+		return nil, nil
+	}
+
+	sel := &ruleSelection{}
+	var err error
+	if sel.include, err = parseRuleIDs(query.Get("include")); err != nil {
+		return nil, err
+	}
+	if sel.exclude, err = parseRuleIDs(query.Get("exclude")); err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+func parseRuleIDs(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	ids := map[string]bool{}
+	for _, id := range strings.Split(strings.ToUpper(list), ",") {
+		id = strings.TrimSpace(id)
+		if _, ok := allRules[id]; !ok {
+			return nil, errors.Errorf("unknown rule %s", id)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// enabled tells if issues of the rule with the given ID are selected.
+func (sel *ruleSelection) enabled(id string) bool {
+	if sel == nil {
+		return true
+	}
+	return (sel.include == nil || sel.include[id]) && !sel.exclude[id]
+}
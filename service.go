@@ -20,7 +20,11 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"bitbucket.org/liamstask/goose/lib/goose"
 
@@ -29,6 +33,13 @@ import (
 
 const (
 	archiveFileLimit = 5000
+	historyLimit     = 100
+	issueLimit       = 1000
+
+	// Archives are extracted with at most archiveFileSize bytes per file,
+	// and at most archiveSizeLimit bytes decompressed in total
+	archiveFileSize  = 8 << 20
+	archiveSizeLimit = 1 << 30
 )
 
 var (
@@ -80,17 +91,31 @@ func (h headerWrapper) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 func main() {
 	addr := getAddr()
 
-	db, err := newSQLDatabase()
+	db, err := newDatabase()
 	if err != nil {
 		logError("unable to connect to database", err)
 		os.Exit(1)
 	}
-	migrate(db.(*sqlDatabase).DB)
+	migrate(db)
 
 	w := &worker{
-		db:   db,
-		reqs: make(chan string, 10),
+		db:           db,
+		reqs:         make(chan string, 10),
+		held:         map[string]bool{},
+		access:       map[string]accessCheck{},
+		uploads:      make(chan struct{}, runtime.NumCPU()),
+		private:      make(chan struct{}, runtime.NumCPU()),
+		uploadLimit:  envInt("UPLOAD_LIMIT", 32<<20),
+		moduleCache:  os.Getenv("GOMODCACHE"),
+		hosts:        newHosts(),
+		lockLifetime: envDuration("LOCK_LIFETIME", 5*time.Minute),
+		lockRefresh:  envDuration("LOCK_REFRESH", time.Minute),
+	}
+	if w.lockRefresh <= 0 || w.lockRefresh >= w.lockLifetime {
+		logger.Fatalf("LOCK_REFRESH must be positive and shorter than LOCK_LIFETIME")
 	}
+	w.resolver = newResolver(w.hosts)
+	oauth := newOAuth(w)
 
 	h := &headerWrapper{
 		headers: map[string]string{
@@ -102,13 +127,26 @@ func main() {
 		}}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/results/github.com/{user:[a-zA-Z0-9-_.]+}/{repo:[a-zA-Z0-9-_.]+}", h.HandleFunc(w.serveResults)).Methods("GET")
+	w.handleHosts(r, h)
+	r.HandleFunc("/results/{path:.+}", h.HandleFunc(w.serveImportPath)).Methods("GET")
+	r.HandleFunc("/issues", h.HandleFunc(w.serveIssues)).Methods("GET")
+	r.HandleFunc("/issues/summary", h.HandleFunc(w.serveIssueSummary)).Methods("GET")
+	if oauth != nil {
+		r.HandleFunc("/login", h.HandleFunc(oauth.serveLogin)).Methods("GET")
+		r.HandleFunc("/login/callback", h.HandleFunc(oauth.serveCallback)).Methods("GET")
+		r.HandleFunc("/logout", h.HandleFunc(oauth.serveLogout)).Methods("POST")
+		r.HandleFunc("/session", h.HandleFunc(oauth.serveSession)).Methods("GET")
+	}
+	r.HandleFunc("/scans", h.HandleFunc(w.serveUpload)).Methods("POST")
+	r.HandleFunc("/scans/{id:[0-9a-f]+}", h.HandleFunc(w.serveUploadResults)).Methods("GET")
+	r.HandleFunc("/ratelimit", h.HandleFunc(w.serveRateLimits)).Methods("GET")
 
 	r.PathPrefix("/").Handler(h.Handler(http.FileServer(http.Dir("assets/dist"))))
 
 	for i := 0; i < runtime.NumCPU()*2; i++ {
 		go w.run()
 	}
+	go newJanitor(db).run()
 
 	logger.Printf("listening on %s", addr)
 	if err := http.ListenAndServe(addr, r); err != nil {
@@ -116,17 +154,121 @@ func main() {
 	}
 }
 
-func migrate(db *sql.DB) {
-	migrations := path.Join("db/migrations")
+// handleHosts routes the results of every host. Hosts are routed in order
+// of their names, so that matching doesn't change between runs. History is
+// served below a "-" path element, which GitLab reserves and no host allows
+// as a repository name. Those routes go first all the same, nested GitLab
+// groups and module paths would swallow them otherwise.
+func (w *worker) handleHosts(r *mux.Router, h *headerWrapper) {
+	names := make([]string, 0, len(w.hosts))
+	for name := range w.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		host := w.hosts[name]
+		repo := fmt.Sprintf("/results/{host:%s}/{repo:%s}", regexp.QuoteMeta(host.name()), host.pattern())
+		for _, prefix := range []string{repo + "@{ref:" + refName + "}", repo} {
+			r.HandleFunc(prefix+"/-/history", h.HandleFunc(w.serveHistory)).Methods("GET").Name("history")
+			r.HandleFunc(prefix+"/-/history/{id:[0-9]+}", h.HandleFunc(w.serveScan)).Methods("GET").Name("scan")
+
+			// Repositories are always two levels deep on some hosts, so
+			// history can't be mistaken for a repository there. It used to
+			// be served without the /-/ separator.
+			if host.pattern() == repoName+"/"+repoName {
+				r.HandleFunc(prefix+"/history", h.HandleFunc(w.serveHistory)).Methods("GET").Name("history")
+				r.HandleFunc(prefix+"/history/{id:[0-9]+}", h.HandleFunc(w.serveScan)).Methods("GET").Name("scan")
+			}
+
+			r.HandleFunc(prefix, h.HandleFunc(w.serveResults)).Methods("GET").Name("results")
+		}
+	}
+}
+
+// newHosts sets up the supported code hosts, keyed by name.
+func newHosts() map[string]host {
+	gitlabURL := os.Getenv("GITLAB_URL")
+	if gitlabURL == "" {
+		gitlabURL = "https://gitlab.com"
+	}
+	gitlab, err := newGitLabHost(gitlabURL)
+	if err != nil {
+		logger.Fatalf("unable to configure GitLab: %s", err)
+	}
+
+	// Several tokens may be given to spread requests over their budgets
+	github, err := newGitHubHost("https://api.github.com", strings.Split(os.Getenv("GITHUB_TOKEN"), ","))
+	if err != nil {
+		logger.Fatalf("unable to configure GitHub: %s", err)
+	}
+
+	bitbucketAPI, bitbucketURL := os.Getenv("BITBUCKET_API_URL"), os.Getenv("BITBUCKET_URL")
+	if bitbucketAPI == "" {
+		bitbucketAPI = "https://api.bitbucket.org/2.0"
+	}
+	if bitbucketURL == "" {
+		bitbucketURL = "https://bitbucket.org"
+	}
+	bitbucket, err := newBitbucketHost(bitbucketAPI, bitbucketURL)
+	if err != nil {
+		logger.Fatalf("unable to configure Bitbucket: %s", err)
+	}
+
+	// Modules are served under /results/mod/...
+	proxy, err := newModuleProxy(moduleProxyURL(os.Getenv("GOPROXY")))
+	if err != nil {
+		logger.Fatalf("unable to configure module proxy: %s", err)
+	}
+
+	hosts := map[string]host{}
+	for _, h := range []host{github, gitlab, bitbucket, proxy} {
+		hosts[h.name()] = h
+	}
+
+	// Sources on disk are served under /results/local/...
+	if dir := os.Getenv("LOCAL_SOURCES"); dir != "" {
+		hosts["local"] = newLocalHost("local", dir)
+	}
+	return hosts
+}
+
+// newOAuth sets up signing in with GitHub, if configured, so that users can
+// scan their private repositories.
+func newOAuth(w *worker) *githubOAuth {
+	clientID := os.Getenv("GITHUB_CLIENT_ID")
+	if clientID == "" {
+		return nil
+	}
+
+	sessions, err := newSessionStore(os.Getenv("SESSION_SECRET"), envDuration("SESSION_LIFETIME", 7*24*time.Hour))
+	if err != nil {
+		logger.Fatalf("unable to configure sessions: %s", err)
+	}
+	w.sessions = sessions
+
+	github := w.hosts["github.com"].(*githubHost)
+	return newGitHubOAuth(clientID, os.Getenv("GITHUB_CLIENT_SECRET"), github, sessions)
+}
+
+func migrate(db database) {
+	switch db := db.(type) {
+	case *sqlDatabase:
+		runMigrations(db.DB, db.dialect)
+	case *memoryDatabase:
+		// Nothing to migrate
+	default:
+		logger.Fatalf("unable to run migrations: unsupported database %T", db)
+	}
+}
+
+func runMigrations(db *sql.DB, dialect *sqlDialect) {
+	migrations := path.Join(dialect.migrations, "migrations")
 
 	gooseConf := goose.DBConf{
 		MigrationsDir: migrations,
 		Env:           "gas-web",
-		Driver: goose.DBDriver{
-			Name:    "mysql",
-			Import:  "github.com/go-sql-driver/mysql",
-			Dialect: &goose.MySqlDialect{},
-		},
+		Driver:        dialect.driver,
 	}
 
 	desiredVersion, err := goose.GetMostRecentDBVersion(migrations)
@@ -140,4 +282,10 @@ func migrate(db *sql.DB) {
 	}
 
 	logger.Printf("ran migrations up to version %d", desiredVersion)
+
+	// Some data migrations can't be expressed in SQL
+	err = compressLegacyScans(db, dialect.placeholder)
+	if err != nil {
+		logger.Fatalf("unable to run migrations: %s", err)
+	}
 }
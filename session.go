@@ -0,0 +1,261 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	sessionCookie = "gas-session"
+	stateCookie   = "gas-oauth-state"
+)
+
+// A session is a user signed in with GitHub. Sessions live in an encrypted
+// cookie, so every node can read them without sharing any state.
+type session struct {
+	Login   string    `json:"login"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (s *session) String() string {
+	// Never log the token
+	return fmt.Sprintf("session of %s", s.Login)
+}
+
+// A sessionStore seals sessions into cookies with AES-GCM.
+type sessionStore struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+}
+
+// newSessionStore derives the cookie key from secret, which must be the
+// same on all nodes.
+func newSessionStore(secret string, lifetime time.Duration) (*sessionStore, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("session secret must be at least 32 characters")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	return &sessionStore{aead, lifetime}, nil
+}
+
+// read returns the session of a request, or nil if there is no valid one.
+func (ss *sessionStore) read(req *http.Request) *session {
+	if ss == nil {
+		return nil
+	}
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < ss.aead.NonceSize() {
+		return nil
+	}
+	nonce, sealed := sealed[:ss.aead.NonceSize()], sealed[ss.aead.NonceSize():]
+	raw, err := ss.aead.Open(nil, nonce, sealed, []byte(sessionCookie))
+	if err != nil {
+		return nil
+	}
+
+	s := &session{}
+	if err := json.Unmarshal(raw, s); err != nil || time.Now().After(s.Expires) {
+		return nil
+	}
+	return s
+}
+
+// write stores a session in a cookie on the response.
+func (ss *sessionStore) write(resp http.ResponseWriter, req *http.Request, s *session) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	nonce := make([]byte, ss.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.New(err)
+	}
+	sealed := ss.aead.Seal(nonce, nonce, raw, []byte(sessionCookie))
+
+	setCookie(resp, req, sessionCookie, base64.RawURLEncoding.EncodeToString(sealed), s.Expires)
+	return nil
+}
+
+// setCookie sets a cookie that scripts can't read. An empty value with a
+// zero expiry deletes the cookie.
+func setCookie(resp http.ResponseWriter, req *http.Request, name, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https",
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(resp, cookie)
+}
+
+// githubOAuth signs users in with the GitHub OAuth web flow. Signed in
+// users can scan the private repositories their token can read.
+type githubOAuth struct {
+	clientID     string
+	clientSecret string
+	web          string
+	github       *githubHost
+	sessions     *sessionStore
+}
+
+func newGitHubOAuth(clientID, clientSecret string, github *githubHost, sessions *sessionStore) *githubOAuth {
+	return &githubOAuth{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		web:          "https://github.com",
+		github:       github,
+		sessions:     sessions,
+	}
+}
+
+// serveLogin redirects to GitHub to ask for access to private repositories.
+// The state parameter is tied to the browser with a cookie to prevent CSRF.
+func (o *githubOAuth) serveLogin(resp http.ResponseWriter, req *http.Request) {
+	state, err := randomHex(16)
+	if err != nil {
+		logError("unable to start login", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setCookie(resp, req, stateCookie, state, time.Now().Add(10*time.Minute))
+
+	query := url.Values{
+		"client_id": {o.clientID},
+		"scope":     {"repo"},
+		"state":     {state},
+	}
+	http.Redirect(resp, req, o.web+"/login/oauth/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// serveCallback completes the login once GitHub redirects back.
+func (o *githubOAuth) serveCallback(resp http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(stateCookie)
+	state := req.URL.Query().Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	setCookie(resp, req, stateCookie, "", time.Time{})
+
+	token, err := o.exchange(req.Context(), req.URL.Query().Get("code"))
+	if err != nil {
+		logError("unable to complete login", err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	login, err := o.github.withToken(token).login(req.Context())
+	if err != nil {
+		logError("unable to complete login", err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	s := &session{Login: login, Token: token, Expires: time.Now().Add(o.sessions.lifetime)}
+	if err := o.sessions.write(resp, req, s); err != nil {
+		logError("unable to complete login", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(resp, req, "/", http.StatusFound)
+}
+
+// exchange trades the code GitHub handed out for an access token.
+func (o *githubOAuth) exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"client_id":     {o.clientID},
+		"client_secret": {o.clientSecret},
+		"code":          {code},
+	}
+	req, err := http.NewRequest("POST", o.web+"/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.New(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.New(err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", errors.WrapPrefix(err, "unable to exchange code", 0)
+	}
+	if body.AccessToken == "" {
+		return "", errors.Errorf("unable to exchange code (%s, %s)", res.Status, body.Error)
+	}
+	return body.AccessToken, nil
+}
+
+func (o *githubOAuth) serveLogout(resp http.ResponseWriter, req *http.Request) {
+	setCookie(resp, req, sessionCookie, "", time.Time{})
+	http.Redirect(resp, req, "/", http.StatusFound)
+}
+
+// serveSession tells the UI who is signed in, if anyone.
+func (o *githubOAuth) serveSession(resp http.ResponseWriter, req *http.Request) {
+	s := o.sessions.read(req)
+	if s == nil {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	resp.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(resp, map[string]interface{}{
+		"login":   s.Login,
+		"expires": s.Expires,
+	})
+}
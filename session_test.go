@@ -0,0 +1,280 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+// sessionRequest builds a request carrying the cookies set on rec.
+func sessionRequest(method, target string, rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestSessionStore(t *testing.T) {
+	if _, err := newSessionStore("short", time.Hour); err == nil {
+		t.Fatal("expected short secret to be rejected")
+	}
+
+	ss, err := newSessionStore(testSessionSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := ss.write(rec, req, &session{"user", "token", time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := ss.read(sessionRequest("GET", "/", rec))
+	if s == nil || s.Login != "user" || s.Token != "token" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	if strings.Contains(rec.Header().Get("Set-Cookie"), "token") {
+		t.Fatal("token stored in plain text")
+	}
+
+	// Cookies sealed with another secret or tampered with are ignored
+	other, _ := newSessionStore(strings.Repeat("x", 32), time.Hour)
+	if other.read(sessionRequest("GET", "/", rec)) != nil {
+		t.Fatal("expected session of other secret to be rejected")
+	}
+	tampered := httptest.NewRequest("GET", "/", nil)
+	tampered.AddCookie(&http.Cookie{Name: sessionCookie, Value: rec.Result().Cookies()[0].Value + "x"})
+	if ss.read(tampered) != nil {
+		t.Fatal("expected tampered session to be rejected")
+	}
+
+	rec = httptest.NewRecorder()
+	if err := ss.write(rec, req, &session{"user", "token", time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if ss.read(sessionRequest("GET", "/", rec)) != nil {
+		t.Fatal("expected expired session to be rejected")
+	}
+}
+
+// newPrivateGitHub serves a private repository org/secret that only the
+// token "member" can read, and a public repository org/public.
+func newPrivateGitHub(t *testing.T) *httptest.Server {
+	commit := "89abcdef0123456789abcdef0123456789abcdef"
+	archive := buildTarball(t, "org-secret-89abcde", commit, testSources)
+
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		member := req.Header.Get("Authorization") == "token member"
+		switch {
+		case req.URL.Path == "/login/oauth/access_token":
+			if req.FormValue("code") != "code" || req.FormValue("client_secret") != "secret" {
+				resp.Write([]byte(`{"error":"bad_verification_code"}`))
+				return
+			}
+			resp.Write([]byte(`{"access_token":"member"}`))
+		case req.URL.Path == "/user" && member:
+			resp.Write([]byte(`{"login":"member"}`))
+		case req.URL.Path == "/repos/org/public":
+			resp.Write([]byte(`{"private":false}`))
+		case req.URL.Path == "/repos/org/secret" && member:
+			resp.Write([]byte(`{"private":true}`))
+		case req.URL.Path == "/repos/org/secret/tarball" && member:
+			resp.Header().Set("ETag", `"secret"`)
+			if req.Method == "GET" {
+				resp.Write(archive)
+			}
+		case req.URL.Path == "/repos/org/secret/commits/HEAD" && member:
+			resp.Write([]byte(commit))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestOAuthLogin(t *testing.T) {
+	srv := newPrivateGitHub(t)
+	defer srv.Close()
+
+	github, _ := newGitHubHost(srv.URL, nil)
+	sessions, _ := newSessionStore(testSessionSecret, time.Hour)
+	o := newGitHubOAuth("client", "secret", github, sessions)
+	o.web = srv.URL
+
+	rec := httptest.NewRecorder()
+	o.serveLogin(rec, httptest.NewRequest("GET", "/login", nil))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || rec.Code != http.StatusFound || location.Query().Get("scope") != "repo" {
+		t.Fatalf("unexpected redirect %d to %s", rec.Code, location)
+	}
+	state := location.Query().Get("state")
+
+	// The state must match the cookie of the same browser
+	callback := httptest.NewRecorder()
+	o.serveCallback(callback, httptest.NewRequest("GET", "/login/callback?code=code&state="+state, nil))
+	if callback.Code != http.StatusBadRequest {
+		t.Fatalf("expected callback without state cookie to fail, got %d", callback.Code)
+	}
+
+	callback = httptest.NewRecorder()
+	o.serveCallback(callback, sessionRequest("GET", "/login/callback?code=code&state="+state, rec))
+	if callback.Code != http.StatusFound {
+		t.Fatalf("unexpected callback status %d", callback.Code)
+	}
+
+	info := httptest.NewRecorder()
+	o.serveSession(info, sessionRequest("GET", "/session", callback))
+	var body struct {
+		Login string `json:"login"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(info.Body.Bytes(), &body); err != nil || body.Login != "member" || body.Token != "" {
+		t.Fatalf("unexpected session %s", info.Body.String())
+	}
+
+	loggedOut := httptest.NewRecorder()
+	o.serveLogout(loggedOut, sessionRequest("POST", "/logout", callback))
+	info = httptest.NewRecorder()
+	o.serveSession(info, sessionRequest("GET", "/session", loggedOut))
+	if info.Code != http.StatusUnauthorized {
+		t.Fatalf("expected session to be cleared, got %d", info.Code)
+	}
+}
+
+func TestPrivateResults(t *testing.T) {
+	srv := newPrivateGitHub(t)
+	defer srv.Close()
+
+	github, _ := newGitHubHost(srv.URL, nil)
+	w := newTestWorker(map[string]host{"github.com": github})
+	w.sessions, _ = newSessionStore(testSessionSecret, time.Hour)
+
+	login := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		w.sessions.write(rec, httptest.NewRequest("GET", "/", nil), &session{token, token, time.Now().Add(time.Hour)})
+		return rec
+	}
+
+	path := "github.com/org/secret"
+	rec := httptest.NewRecorder()
+	if !w.servePrivateResults(rec, sessionRequest("GET", "/results/"+path, login("member")), path) {
+		t.Fatal("expected private repository to be served")
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+	if !strings.Contains(rec.Body.String(), `"file":"main.go"`) {
+		t.Fatalf("unexpected results %s", rec.Body.String())
+	}
+
+	// Anyone else gets the public results, which don't exist
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/results/"+path, nil),
+		sessionRequest("GET", "/results/"+path, login("outsider")),
+	} {
+		if w.servePrivateResults(httptest.NewRecorder(), req, path) {
+			t.Fatal("private results served without access")
+		}
+	}
+	if w.servePrivateResults(httptest.NewRecorder(), sessionRequest("GET", "/", login("member")), "github.com/org/public") {
+		t.Fatal("public repository served as private")
+	}
+
+	if _, err := w.db.fetchResults(path); err != sql.ErrNoRows {
+		t.Fatalf("private results stored publicly (%v)", err)
+	}
+
+	// Public scans treat the repository as missing, even if their token
+	// could read it
+	github, _ = newGitHubHost(srv.URL, []string{"member"})
+	w.hosts["github.com"] = github
+	if err := w.process("node", path); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+	if s, err := w.db.fetchResults(path); err != nil || !s.Missing || len(s.Issues) != 0 {
+		t.Fatalf("private repository stored publicly (%v)", err)
+	}
+	if issues, err := w.db.queryIssues(issueFilter{}, issueLimit); err != nil || len(issues) != 0 {
+		t.Fatalf("private issues stored publicly (%v)", err)
+	}
+}
+
+func TestPrivateResultsParallel(t *testing.T) {
+	srv := newPrivateGitHub(t)
+	defer srv.Close()
+
+	// Count the requests that reach GitHub
+	var mu sync.Mutex
+	hits := map[string]int{}
+	target, _ := url.Parse(srv.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	counting := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		hits[req.Method+" "+req.URL.Path]++
+		mu.Unlock()
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer counting.Close()
+
+	github, _ := newGitHubHost(counting.URL, nil)
+	w := newTestWorker(map[string]host{"github.com": github})
+	w.sessions, _ = newSessionStore(testSessionSecret, time.Hour)
+	rec := httptest.NewRecorder()
+	w.sessions.write(rec, httptest.NewRequest("GET", "/", nil), &session{"member", "member", time.Now().Add(time.Hour)})
+
+	path := "github.com/org/secret"
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		req := sessionRequest("GET", "/results/"+path, rec)
+		go func() {
+			defer wg.Done()
+			res := httptest.NewRecorder()
+			w.servePrivateResults(res, req, path)
+			codes <- res.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+
+	// Access is remembered for the next request
+	w.servePrivateResults(httptest.NewRecorder(), sessionRequest("GET", "/results/"+path, rec), path)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["GET /repos/org/secret/tarball"] != 1 {
+		t.Errorf("expected a single scan, got %v", hits)
+	}
+	if hits["GET /repos/org/secret"] > cap(codes) {
+		t.Errorf("expected access to be remembered, got %v", hits)
+	}
+}
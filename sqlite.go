@@ -0,0 +1,60 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"bitbucket.org/liamstask/goose/lib/goose"
+	"github.com/go-errors/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDialect needs no FOR UPDATE, transactions already hold the write
+// lock. The driver binds empty blobs as NULL.
+var sqliteDialect = &sqlDialect{
+	placeholder: questionMark,
+	emptyBlob:   "X''",
+	upsert:      upsertExcluded,
+	migrations:  "db/sqlite",
+	driver: goose.DBDriver{
+		Name:    "sqlite3",
+		Import:  "github.com/mattn/go-sqlite3",
+		Dialect: &goose.Sqlite3Dialect{},
+	},
+}
+
+// newSQLiteDatabase opens the SQLite database file at the given path.
+// Transactions are started with BEGIN IMMEDIATE, which takes the database
+// write lock up front. That makes the read-then-write in lockPath atomic
+// across all connections and processes on the host.
+func newSQLiteDatabase(path string) (database, error) {
+	dsn := path + "?_txlock=immediate&_busy_timeout=10000"
+	if strings.Contains(path, "?") {
+		dsn = path + "&_txlock=immediate&_busy_timeout=10000"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to talk to DB", 0)
+	}
+
+	// Let readers proceed while a worker holds the write lock
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to enable write-ahead log", 0)
+	}
+
+	return &sqlDatabase{db, sqliteDialect}, nil
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gorilla/mux"
+)
+
+// An upload is the scan of an archive posted to /scans. Uploads are kept
+// apart from repository results and can only be read with the secret token
+// handed out when they were created.
+type upload struct {
+	ID        string
+	TokenHash []byte
+	Timestamp time.Time
+	RuleSet   string
+
+	// Results holds the gzip-compressed response document
+	Results []byte
+}
+
+// randomHex returns n random bytes, hex-encoded.
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.New(err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// sizeLimitReader fails with err, or a generic error if it is nil, once
+// more than n bytes were read, and remembers that it did.
+type sizeLimitReader struct {
+	r        io.Reader
+	n        int64
+	err      error
+	exceeded bool
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, lr.fail()
+	}
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, lr.fail()
+	}
+	return n, err
+}
+
+func (lr *sizeLimitReader) fail() error {
+	lr.exceeded = true
+	if lr.err != nil {
+		return lr.err
+	}
+	return errors.New("upload too large")
+}
+
+// uploadedArchive returns the archive in the body of a request. It may be
+// posted as is, or as the "archive" field of a multipart form.
+func uploadedArchive(req *http.Request) (io.Reader, error) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		return req.Body, nil
+	}
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "archive" {
+			return part, nil
+		}
+	}
+}
+
+// serveUpload scans an uploaded .tar.gz or .zip archive right away. The response
+// holds the scan ID and the token needed to fetch the results again later,
+// along with the results themselves.
+func (w *worker) serveUpload(resp http.ResponseWriter, req *http.Request) {
+	sel, err := parseRuleSelection(req.URL.Query())
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case w.uploads <- struct{}{}:
+		defer func() { <-w.uploads }()
+	default:
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	limited := &sizeLimitReader{r: req.Body, n: w.uploadLimit}
+	req.Body = ioutil.NopCloser(limited)
+	archive, err := uploadedArchive(req)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "gas-web")
+	if err != nil {
+		logError("unable to process upload", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tree, err := extractArchive(req.Context(), archive, dir)
+	if limited.exceeded || err == errArchiveTooLarge {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err == errUnsupportedArchive {
+		resp.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		logger.Printf("unable to process upload: %s", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	analyzer, issues, err := w.analyzeTree(req.Context(), tree)
+	if err != nil {
+		logError("unable to process upload", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u, token, err := w.storeUpload(tree, analyzer, issues)
+	if err != nil {
+		logError("unable to store upload", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	unzipped, err := gzip.NewReader(bytes.NewReader(u.Results))
+	if err != nil {
+		logError("invalid results document", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	doc, err := ioutil.ReadAll(unzipped)
+	if err == nil && sel != nil {
+		doc, err = filterDocument(doc, sel)
+	}
+	if err != nil {
+		logError("invalid results document", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	raw, err := json.Marshal(map[string]interface{}{
+		"id":      u.ID,
+		"token":   token,
+		"results": json.RawMessage(doc),
+	})
+	if err != nil {
+		logError("unable to marshal response", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "private, no-store")
+	resp.Header().Set("Location", "/scans/"+u.ID)
+	resp.WriteHeader(http.StatusCreated)
+	resp.Write(raw)
+}
+
+func (w *worker) storeUpload(tree *sourceTree, analyzer *analyzer, issues []*issue) (*upload, string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := &scan{
+		Commit:  tree.commit,
+		RuleSet: ruleSetVersion(),
+		Issues:  issues,
+	}
+	u := &upload{
+		ID:        id,
+		TokenHash: hashToken(token),
+		Timestamp: time.Now(),
+		RuleSet:   s.RuleSet,
+	}
+	u.Results, err = buildDocument(u.Timestamp, s, analyzer)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := w.db.storeUpload(u); err != nil {
+		return nil, "", err
+	}
+	return u, token, nil
+}
+
+// serveUploadResults returns the results of an upload, given its token as
+// a bearer token or in the token query parameter.
+func (w *worker) serveUploadResults(resp http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	u, err := w.db.fetchUpload(mux.Vars(req)["id"])
+	if err != nil && err != sql.ErrNoRows {
+		logError("unable to fetch upload", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Unknown uploads and wrong tokens look the same
+	if err == sql.ErrNoRows || subtle.ConstantTimeCompare(u.TokenHash, hashToken(token)) != 1 {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp.Header().Set("Cache-Control", "private, no-store")
+	writeDocument(resp, req, u.Results)
+}
+
+// insertUpload implements storeUpload for the SQL backends.
+func insertUpload(db *sql.DB, placeholder func(n int) string, u *upload) error {
+	_, err := db.Exec(
+		`INSERT INTO uploads (id, token_hash, timestamp, ruleset, results)
+		 VALUES (`+placeholder(1)+`, `+placeholder(2)+`, `+placeholder(3)+`, `+placeholder(4)+`, `+placeholder(5)+`)`,
+		u.ID, u.TokenHash, u.Timestamp.Unix(), u.RuleSet, u.Results)
+	if err != nil {
+		return errors.WrapPrefix(err, "unable to store upload", 0)
+	}
+	return nil
+}
+
+// selectUpload implements fetchUpload for the SQL backends.
+func selectUpload(db *sql.DB, placeholder func(n int) string, id string) (*upload, error) {
+	r := db.QueryRow(
+		`SELECT token_hash, timestamp, ruleset, results FROM uploads WHERE id = `+placeholder(1), id)
+
+	var timestamp int64
+	u := &upload{ID: id}
+	err := r.Scan(&u.TokenHash, &timestamp, &u.RuleSet, &u.Results)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	u.Timestamp = time.Unix(timestamp, 0)
+	return u, nil
+}
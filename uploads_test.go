@@ -0,0 +1,125 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func newUploadRouter(w *worker) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/scans", w.serveUpload).Methods("POST")
+	r.HandleFunc("/scans/{id:[0-9a-f]+}", w.serveUploadResults).Methods("GET")
+	return r
+}
+
+type uploadResponse struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Results struct {
+		Results struct {
+			Issues []struct {
+				File string `json:"file"`
+				Rule string `json:"rule"`
+			} `json:"issues"`
+		} `json:"results"`
+	} `json:"results"`
+}
+
+func TestUpload(t *testing.T) {
+	w := newTestWorker(nil)
+	w.uploads = make(chan struct{}, 1)
+	w.uploadLimit = 1 << 20
+	r := newUploadRouter(w)
+
+	// Zip archives are accepted just as well
+	zipped := buildZip(t, "", "", testSources)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/scans", bytes.NewReader(zipped)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d for zip archive", rec.Code)
+	}
+
+	archive := buildTarball(t, "project", "", testSources)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/scans", bytes.NewReader(archive)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var res uploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID == "" || res.Token == "" || len(res.Results.Results.Issues) == 0 {
+		t.Fatalf("unexpected response %s", rec.Body.String())
+	}
+	for _, i := range res.Results.Results.Issues {
+		if i.File != "main.go" || i.Rule == "" {
+			t.Errorf("unexpected issue %+v", i)
+		}
+	}
+
+	// Results are only handed out with the token
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/scans/"+res.ID+"?token=wrong", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/scans/"+res.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+res.Token)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+
+	// Uploads stay out of the public issue index
+	if issues, err := w.db.queryIssues(issueFilter{}, issueLimit); err != nil || len(issues) != 0 {
+		t.Fatalf("expected no public issues, got %d (%v)", len(issues), err)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	w := newTestWorker(nil)
+	w.uploads = make(chan struct{}, 1)
+	w.uploadLimit = 1024
+	r := newUploadRouter(w)
+
+	// Random content doesn't compress below the limit
+	padding, _ := randomHex(4096)
+	large := buildTarball(t, "project", "", map[string]string{"main.go": "package main\n// " + padding + "\n"})
+	truncated := buildTarball(t, "project", "", map[string]string{"main.go": "package main\n"})[:20]
+
+	for body, status := range map[string]int{
+		"":                            http.StatusUnsupportedMediaType,
+		"PK\x03\x04 not really a zip": http.StatusBadRequest,
+		"plain text":                  http.StatusUnsupportedMediaType,
+		string(truncated):             http.StatusBadRequest,
+		string(large):                 http.StatusRequestEntityTooLarge,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", "/scans", bytes.NewReader([]byte(body))))
+		if rec.Code != status {
+			t.Errorf("expected status %d, got %d", status, rec.Code)
+		}
+	}
+}
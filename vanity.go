@@ -0,0 +1,293 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/go-errors/errors"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Import paths are resolved at most once per resolveLifetime, and at
+	// most resolveCacheLimit of them are remembered at a time
+	resolveLifetime   = 1 * time.Hour
+	resolveCacheLimit = 10000
+	resolveBodyLimit  = 1 << 20
+)
+
+var errUnsupported = errors.New("unsupported import path")
+
+var validRef = regexp.MustCompile("^" + refName + "$")
+
+// remoteImportPath matches import paths starting with a domain name, without
+// a port, user info, query, fragment or empty elements.
+var remoteImportPath = regexp.MustCompile(`^[a-z0-9-]+(?:\.[a-z0-9-]+)+(?:/[A-Za-z0-9_.~+-]+)*$`)
+
+// gopkgIn matches gopkg.in import paths, e.g. gopkg.in/yaml.v2 or
+// gopkg.in/user/pkg.v1.
+var gopkgIn = regexp.MustCompile(`^gopkg\.in/(?:([a-zA-Z0-9-_]+)/)?([a-zA-Z0-9-_.]+)\.v[0-9]+(?:/|$)`)
+
+// A resolver maps Go import paths to repositories on a supported host,
+// following go-get meta tags for vanity import paths.
+type resolver struct {
+	hosts  map[string]host
+	client *http.Client
+	scheme string
+
+	mu    sync.Mutex
+	cache map[string]resolved
+}
+
+type resolved struct {
+	path    string
+	err     error
+	expires time.Time
+}
+
+func newResolver(hosts map[string]host) *resolver {
+	return &resolver{
+		hosts:  hosts,
+		client: publicClient(),
+		scheme: "https",
+		cache:  map[string]resolved{},
+	}
+}
+
+// publicClient returns an HTTP client that refuses to connect to private,
+// loopback and other non-public addresses. Import paths are user input, so
+// following them must not give access to internal services. The check runs
+// on the address actually dialed, which also covers redirects and DNS
+// rebinding.
+func publicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errors.Errorf("refusing to connect to non-public address %s", address)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 20 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+				return errors.Errorf("refusing to follow redirect to %s", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	// Carrier-grade NAT (RFC 6598) is not covered by IsPrivate
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// resolve returns the result path, e.g. github.com/golang/net, of the
+// repository containing the package at importPath.
+func (r *resolver) resolve(ctx context.Context, importPath string) (string, error) {
+	importPath = strings.Trim(importPath, "/")
+	if !validImportPath(importPath) || !remoteImportPath.MatchString(importPath) {
+		return "", errUnsupported
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	cached, ok := r.cache[importPath]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.path, cached.err
+	}
+
+	path, err := r.lookup(ctx, importPath)
+	if err != nil && err != errUnsupported && err != errNotFound {
+		// Don't cache what might be a temporary failure
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p, c := range r.cache {
+		if now.After(c.expires) {
+			delete(r.cache, p)
+		}
+	}
+	if len(r.cache) < resolveCacheLimit {
+		r.cache[importPath] = resolved{path, err, now.Add(resolveLifetime)}
+	}
+	return path, err
+}
+
+func (r *resolver) lookup(ctx context.Context, importPath string) (string, error) {
+	if path, ok := r.match(importPath, false); ok {
+		return path, nil
+	}
+
+	if m := gopkgIn.FindStringSubmatch(importPath); m != nil {
+		user := m[1]
+		if user == "" {
+			user = "go-" + m[2]
+		}
+		return "github.com/" + user + "/" + m[2], nil
+	}
+
+	res, err := r.get(ctx, r.scheme+"://"+importPath+"?go-get=1")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(res.Body, resolveBodyLimit))
+	if err != nil {
+		return "", errors.WrapPrefix(err, fmt.Sprintf("unable to parse go-get page of %s", importPath), 0)
+	}
+
+	path := ""
+	doc.Find(`meta[name="go-import"]`).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		fields := strings.Fields(s.AttrOr("content", ""))
+		if len(fields) != 3 || fields[1] != "git" {
+			return true
+		}
+		if importPath != fields[0] && !strings.HasPrefix(importPath, fields[0]+"/") {
+			return true
+		}
+
+		root, err := url.Parse(fields[2])
+		if err != nil || (root.Scheme != "https" && root.Scheme != "http") {
+			return true
+		}
+		repo := strings.TrimSuffix(strings.Trim(root.Path, "/"), ".git")
+		if p, ok := r.match(root.Host+"/"+repo, true); ok {
+			path = p
+			return false
+		}
+		return true
+	})
+
+	if path == "" {
+		return "", errUnsupported
+	}
+	return path, nil
+}
+
+// match finds the repository on a supported host that importPath lies in.
+// If exact is set, importPath must name the repository itself.
+func (r *resolver) match(importPath string, exact bool) (string, bool) {
+	h, repo, err := hostRepo(r.hosts, importPath)
+	if err != nil {
+		return "", false
+	}
+
+	pattern := regexp.MustCompile("^" + h.pattern() + "$")
+	if exact {
+		return h.name() + "/" + repo, pattern.MatchString(repo)
+	}
+
+	// Without a go-get lookup, the repository is only known for sure if
+	// the host doesn't allow nested repositories
+	parts := strings.Split(repo, "/")
+	for n := 1; n <= len(parts); n++ {
+		prefix := strings.Join(parts[:n], "/")
+		if pattern.MatchString(prefix) {
+			if pattern.MatchString(prefix + "/nested") {
+				return "", false
+			}
+			return h.name() + "/" + prefix, true
+		}
+	}
+	return "", false
+}
+
+func (r *resolver) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	res, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("unable to fetch %s (%s)", url, res.Status)
+	}
+	return res, nil
+}
+
+// serveImportPath redirects results for an import path, e.g.
+// /results/golang.org/x/net/html, to the repository it lives in. A ref
+// such as /results/golang.org/x/net@v1.0.0 is kept.
+func (w *worker) serveImportPath(resp http.ResponseWriter, req *http.Request) {
+	importPath, ref := splitRef(mux.Vars(req)["path"])
+	if ref != "" && !validRef.MatchString(ref) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	path, err := w.resolver.resolve(req.Context(), importPath)
+	if err == errNotFound || err == errUnsupported {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(fmt.Sprintf("unable to resolve import path %s", importPath), err)
+		resp.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if ref != "" {
+		path += "@" + ref
+	}
+	http.Redirect(resp, req, "/results/"+path, http.StatusFound)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testResolver() *resolver {
+	r := newResolver(newTestHosts())
+	r.client = http.DefaultClient
+	r.scheme = "http"
+	return r
+}
+
+func newTestHosts() map[string]host {
+	github, _ := newGitHubHost("https://api.github.com", nil)
+	gitlab, _ := newGitLabHost("https://gitlab.com")
+	bitbucket, _ := newBitbucketHost("https://api.bitbucket.org/2.0", "https://bitbucket.org")
+	return map[string]host{
+		"github.com":    github,
+		"gitlab.com":    gitlab,
+		"bitbucket.org": bitbucket,
+	}
+}
+
+func TestResolveWithoutLookup(t *testing.T) {
+	r := testResolver()
+	r.client = nil // Must not be used
+
+	for importPath, expected := range map[string]string{
+		"github.com/user/repo":            "github.com/user/repo",
+		"github.com/user/repo/sub/pkg":    "github.com/user/repo",
+		"bitbucket.org/owner/repo/pkg":    "bitbucket.org/owner/repo",
+		"gopkg.in/yaml.v2":                "github.com/go-yaml/yaml",
+		"gopkg.in/user/pkg.v1/sub":        "github.com/user/pkg",
+		"gopkg.in/check.v1":               "github.com/go-check/check",
+		"/github.com/user/repo/trailing/": "github.com/user/repo",
+	} {
+		path, err := r.resolve(context.Background(), importPath)
+		if err != nil || path != expected {
+			t.Errorf("resolved %s to %s (%v), expected %s", importPath, path, err, expected)
+		}
+	}
+}
+
+func TestResolveGoImport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("go-get") != "1" {
+			t.Errorf("unexpected request %s", req.URL)
+		}
+		host := req.Host
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/x/net"):
+			resp.Write([]byte(`<html><head>
+				<meta name="go-import" content="` + host + `/x/tools git https://github.com/golang/tools">
+				<meta name="go-import" content="` + host + `/x/net git https://github.com/golang/net">
+				</head></html>`))
+		case strings.HasPrefix(req.URL.Path, "/nested"):
+			resp.Write([]byte(`<meta name="go-import" content="` + host + `/nested git https://gitlab.com/group/sub/project.git">`))
+		case strings.HasPrefix(req.URL.Path, "/hg"):
+			resp.Write([]byte(`<meta name="go-import" content="` + host + `/hg hg https://github.com/user/repo">`))
+		case strings.HasPrefix(req.URL.Path, "/elsewhere"):
+			resp.Write([]byte(`<meta name="go-import" content="` + host + `/elsewhere git https://example.com/repo">`))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// Every host name leads to the test server
+	r := testResolver()
+	r.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+	host := "vanity.example.com"
+
+	for importPath, expected := range map[string]string{
+		host + "/x/net/html": "github.com/golang/net",
+		host + "/nested/pkg": "gitlab.com/group/sub/project",
+	} {
+		path, err := r.resolve(context.Background(), importPath)
+		if err != nil || path != expected {
+			t.Errorf("resolved %s to %s (%v), expected %s", importPath, path, err, expected)
+		}
+	}
+
+	for importPath, expected := range map[string]error{
+		host + "/hg":        errUnsupported,
+		host + "/elsewhere": errUnsupported,
+		host + "/missing":   errNotFound,
+
+		// Only plain import paths are looked up
+		host + ":8080/x/net":       errUnsupported,
+		"user@" + host + "/x/net":  errUnsupported,
+		host + "/x/net?go-get=0":   errUnsupported,
+		host + "/x/net#fragment":   errUnsupported,
+		host + "//x/net":           errUnsupported,
+		host + "/../x/net":         errUnsupported,
+		"localhost/x/net":          errUnsupported,
+		"127.0.0.1.nip.io:1/x/net": errUnsupported,
+	} {
+		if _, err := r.resolve(context.Background(), importPath); err != expected {
+			t.Errorf("expected %v for %s, got %v", expected, importPath, err)
+		}
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	r := testResolver()
+	r.client = nil // Must not be used
+
+	// Expired entries make room for new ones
+	for i := 0; i < resolveCacheLimit; i++ {
+		r.cache[fmt.Sprintf("example.com/%d", i)] = resolved{expires: time.Now().Add(-time.Second)}
+	}
+	if _, err := r.resolve(context.Background(), "github.com/user/repo"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.cache) != 1 {
+		t.Fatalf("expected expired entries to be removed, got %d", len(r.cache))
+	}
+
+	// Once full, nothing more is remembered
+	r.cache = map[string]resolved{}
+	for i := 0; i < resolveCacheLimit; i++ {
+		r.cache[fmt.Sprintf("example.com/%d", i)] = resolved{expires: time.Now().Add(time.Hour)}
+	}
+	if _, err := r.resolve(context.Background(), "github.com/user/other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.cache["github.com/user/other"]; ok || len(r.cache) != resolveCacheLimit {
+		t.Fatalf("expected cache to stay at %d entries, got %d", resolveCacheLimit, len(r.cache))
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		t.Error("connected to loopback address")
+	}))
+	defer server.Close()
+
+	if _, err := publicClient().Get(server.URL); err == nil {
+		t.Fatal("expected connection to loopback address to be refused")
+	}
+
+	for addr, public := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+	} {
+		if isPublicIP(net.ParseIP(addr)) != public {
+			t.Errorf("expected isPublicIP(%s) to be %v", addr, public)
+		}
+	}
+}
@@ -14,20 +14,22 @@
 package main
 
 import (
-	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	gas "github.com/HewlettPackard/gas/core"
 	"github.com/go-errors/errors"
 	"github.com/gorilla/mux"
 	uuid "github.com/satori/go.uuid"
@@ -38,14 +40,46 @@ var (
 	errNotFound    = errors.New("not found")
 )
 
+// commitID matches full, hex-encoded Git commit IDs.
+var commitID = regexp.MustCompile("^[0-9a-f]{40}$")
+
 type worker struct {
-	db   database
-	reqs chan string
+	db       database
+	reqs     chan string
+	hosts    map[string]host
+	resolver *resolver
+
+	// Locks are taken for lockLifetime and renewed every lockRefresh
+	lockLifetime time.Duration
+	lockRefresh  time.Duration
+
+	// uploads limits the number of uploads scanned at the same time, each
+	// of at most uploadLimit bytes
+	uploads     chan struct{}
+	uploadLimit int64
+
+	// private limits the number of private repositories scanned at the
+	// same time
+	private chan struct{}
+
+	// moduleCache is a module cache directory to resolve imports of
+	// scanned packages from, if any
+	moduleCache string
+
+	// sessions reads the sessions of users signed in with GitHub, nil if
+	// signing in is not configured
+	sessions *sessionStore
+
+	// held are the paths waiting for the rate limit of their host to reset,
+	// access the remembered access checks of private repositories
+	mu     sync.Mutex
+	held   map[string]bool
+	access map[string]accessCheck
 }
 
-func (w *worker) queueRequest(user, repo string) bool {
+func (w *worker) queueRequest(path string) bool {
 	select {
-	case w.reqs <- fmt.Sprintf("%s/%s", user, repo):
+	case w.reqs <- path:
 		return true
 	case <-time.After(100 * time.Millisecond):
 		return false
@@ -56,271 +90,539 @@ func (w *worker) run() {
 	nodeID := uuid.NewV4().String()
 	logger.Printf("running worker %s", nodeID)
 
-	for repo := range w.reqs {
+	for path := range w.reqs {
+		if w.hold(nodeID, path) {
+			continue
+		}
+
 		// Process
-		logger.Printf("node %s processing request for %s", nodeID, repo)
-		out, etag, err := w.process(nodeID, repo)
+		logger.Printf("node %s processing request for %s", nodeID, path)
+		err := w.process(nodeID, path)
 
+		// Jobs that ran into the rate limit are retried after the reset
+		if err != nil && w.hold(nodeID, path) {
+			continue
+		}
 		if err != errNotFound && err != errNotModified {
 			logError(fmt.Sprintf("node %s worker error", nodeID), err)
 		}
+	}
+}
 
-		path := fmt.Sprintf("github.com/%s", repo)
-		if err == errNotFound {
-			err := w.db.storeResults(path, "", "", true)
-			logError("unable to store results", err)
-		} else if err == errNotModified {
-			err := w.db.updateTimestamp(path)
-			logError("unable to update timestamp", err)
-		} else if out != nil && err == nil {
-			res, _ := json.Marshal(out)
-			err := w.db.storeResults(path, etag, string(res), false)
-			logError("unable to store results", err)
+// hold checks if the host of path is out of API budget. If so, the request
+// is queued again once the budget was renewed, unless the queue is full by
+// then. The next request for the path queues it again in that case.
+func (w *worker) hold(nodeID, path string) bool {
+	h, _, err := hostRepo(w.hosts, path)
+	if err != nil {
+		return false
+	}
+	th, ok := h.(throttledHost)
+	if !ok {
+		return false
+	}
+	wait := th.throttled()
+	if wait <= 0 {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.held[path] {
+		return true
+	}
+	w.held[path] = true
+
+	logger.Printf("node %s holding %s for %s, rate limit of %s exceeded", nodeID, path, wait.String(), h.name())
+	time.AfterFunc(wait, func() {
+		w.mu.Lock()
+		delete(w.held, path)
+		w.mu.Unlock()
+
+		select {
+		case w.reqs <- path:
+		default:
+			logger.Printf("node %s dropping held %s, queue is full", nodeID, path)
 		}
+	})
+	return true
+}
+
+// record stores the outcome of processing a repository. It must be called
+// while still holding the lock, writes made under a lock that was taken
+// over in the meantime are rejected.
+func (w *worker) record(nodeID, path string, token int64, s *scan, err error) {
+	if err == errNotFound {
+		// Only record a new scan if the repository just disappeared
+		prev, _ := w.db.fetchResults(path)
+		if prev != nil && prev.Missing {
+			err = w.db.updateTimestamp(path, token)
+		} else {
+			err = w.db.storeResults(&scan{Path: path, RuleSet: ruleSetVersion(), Missing: true}, token)
+		}
+	} else if err == errNotModified {
+		err = w.db.updateTimestamp(path, token)
+	} else if s != nil && err == nil {
+		err = w.db.storeResults(s, token)
+	} else {
+		return
 	}
+
+	if err == errStaleLock {
+		logger.Printf("node %s discarding results for %s, lock was taken over", nodeID, path)
+		return
+	}
+	logError("unable to store results", err)
 }
 
-func (w *worker) process(nodeID, repo string) (*gas.Analyzer, string, error) {
+func (w *worker) process(nodeID, path string) error {
 	defer func() {
-		logError(fmt.Sprintf("panic processing %s", repo), recover())
+		logError(fmt.Sprintf("panic processing %s", path), recover())
 	}()
 
-	path := fmt.Sprintf("github.com/%s", repo)
-	t, etag, _, _, err := w.db.fetchResults(path)
-	if err == nil && t.Add(1*time.Hour).After(time.Now()) {
-		logger.Printf("node %s skipping %s, results less than 1 hour old", nodeID, repo)
-		return nil, "", nil
+	ruleSet := ruleSetVersion()
+	etag := ""
+	prev, err := w.db.fetchResults(path)
+	if err == nil {
+		if prev.Checked.Add(1 * time.Hour).After(time.Now()) {
+			logger.Printf("node %s skipping %s, results less than 1 hour old", nodeID, path)
+			return nil
+		}
+		// Unchanged repositories still need a rescan if the rules changed
+		if prev.RuleSet == ruleSet {
+			etag = prev.ETag
+		}
 	}
 
 	// Acquire lock
-	locked := time.Now()
-	lock, err := w.db.lockPath(nodeID, path, 5*time.Minute)
+	lock, err := w.db.lockPath(nodeID, path, w.lockLifetime)
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, "error acquiring lock", 0)
+		return errors.WrapPrefix(err, "error acquiring lock", 0)
 	}
 	if lock == nil {
-		logger.Printf("node %s skipping %s, already locked", nodeID, repo)
-		return nil, "", nil
+		logger.Printf("node %s skipping %s, already locked", nodeID, path)
+		return nil
 	}
 	defer lock.unlock()
 
-	analyzer := buildAnalyzer()
-	url := fmt.Sprintf("https://api.github.com/repos/%s/tarball", repo)
+	hb := startHeartbeat(context.Background(), lock, w.lockRefresh)
+	s, err := w.analyze(hb.ctx, nodeID, path, etag)
+	if lost := hb.stop(); lost != nil {
+		return lost
+	}
 
-	dir, err := ioutil.TempDir("", "gas-web")
+	w.record(nodeID, path, lock.token(), s, err)
+	return err
+}
+
+// analyze downloads and scans a repository, unless it was not modified
+// since the scan with the given ETag. It gives up as soon as ctx is done.
+func (w *worker) analyze(ctx context.Context, nodeID, path, etag string) (*scan, error) {
+	h, _, err := hostRepo(w.hosts, path)
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+		return nil, err
 	}
-	defer os.RemoveAll(dir)
+	return w.analyzeWith(ctx, nodeID, h, path, etag)
+}
 
-	req, err := http.NewRequest("HEAD", url, nil)
+// analyzeWith is like analyze, but fetches the repository from h instead
+// of the host the path refers to, e.g. to use the token of a user.
+func (w *worker) analyzeWith(ctx context.Context, nodeID string, h fetcher, path, etag string) (*scan, error) {
+	ruleSet := ruleSetVersion()
+
+	served, repo, err := hostRepo(w.hosts, path)
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+		return nil, err
+	}
+	repo, ref := splitRef(repo)
+
+	rev, err := h.revision(ctx, repo, ref, etag)
+	if err == errNotModified {
+		logger.Printf("node %s skipping %s, not modified since last fetch", nodeID, path)
+		return nil, err
+	} else if err == errNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", path), 0)
 	}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+	// Forks and mirrors often point at a commit that was analysed before
+	if rev.Commit != "" {
+		prev, err := w.db.findScanByCommit(rev.Commit, ruleSet)
+		if err == nil {
+			logger.Printf("node %s reusing results of %s for %s at %s", nodeID, prev.Path, path, rev.Commit)
+			return reuseScan(prev, path, rev.ETag, linksOf(served, repo, prev.Commit))
+		} else if err != sql.ErrNoRows {
+			logError(fmt.Sprintf("node %s unable to look up commit %s", nodeID, rev.Commit), err)
+		}
 	}
 
-	io.Copy(ioutil.Discard, res.Body)
-	res.Body.Close()
+	dir, err := ioutil.TempDir("", "gas-web")
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", path), 0)
+	}
+	defer os.RemoveAll(dir)
 
-	if res.StatusCode == 304 {
-		// Not modified since last fetch
-		logger.Printf("node %s skipping %s, not modified since last fetch", nodeID, repo)
-		return nil, "", errNotModified
+	tree, err := h.fetch(ctx, repo, rev, dir)
+	if ctx.Err() != nil {
+		return nil, errLostLock
+	} else if err == errNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", path), 0)
 	}
 
-	if res.StatusCode == 404 {
-		return nil, "", errNotFound
+	// Repositories on code hosts are imported by their result path
+	if tree.importPath == "" {
+		tree.importPath = strings.SplitN(path, "/", 2)[0] + "/" + repo
 	}
 
-	if res.StatusCode != 200 {
-		return nil, "", errors.Errorf("unable to process %s (%s)", repo, res.Status)
+	analyzer, issues, err := w.analyzeTree(ctx, tree)
+	if ctx.Err() != nil {
+		return nil, errLostLock
+	} else if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", path), 0)
 	}
 
-	serverTag := res.Header.Get("ETag")
-	if serverTag != "" && etag == serverTag {
-		logger.Printf("node %s skipping %s, not modified since last fetch", nodeID, repo)
-		return nil, "", errNotModified
+	// Fall back to the commit reported by the host, or an abbreviated
+	// commit ID taken from the source
+	commit := tree.commit
+	if commit == "" {
+		commit = rev.Commit
+	}
+	if commit == "" {
+		commit = tree.abbrev
 	}
 
-	req, err = http.NewRequest("GET", url, nil)
+	s := &scan{
+		Path:    path,
+		ETag:    rev.ETag,
+		Commit:  commit,
+		RuleSet: ruleSet,
+		Issues:  issues,
+	}
+	if commit != "" {
+		s.Links = linksOf(served, repo, commit)
+	} else {
+		s.Links = linksOf(served, repo, ref)
+	}
+	s.Results, err = buildDocument(time.Now(), s, analyzer)
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", path), 0)
 	}
 
-	if etag != "" {
-		req.Header.Add("If-None-Match", etag)
-	}
+	logger.Printf("node %s done processing %s", nodeID, path)
+	return s, nil
+}
 
-	res, err = http.DefaultClient.Do(req)
+// reuseScan copies the results of a scan of the same commit in another
+// repository, with the document rewritten for the new path and links.
+func reuseScan(prev *scan, path, etag string, links *repoLinks) (*scan, error) {
+	unzipped, err := gzip.NewReader(bytes.NewReader(prev.Results))
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+		return nil, errors.WrapPrefix(err, "unable to reuse results", 0)
 	}
-	defer io.Copy(ioutil.Discard, res.Body)
-	defer res.Body.Close()
 
-	if res.StatusCode == 304 {
-		// Not modified since last fetch
-		logger.Printf("node %s skipping %s, not modified since last fetch", nodeID, repo)
-		return nil, "", errNotModified
+	var doc struct {
+		Results json.RawMessage `json:"results"`
+	}
+	if err := json.NewDecoder(unzipped).Decode(&doc); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to reuse results", 0)
 	}
 
-	if res.StatusCode == 404 {
-		return nil, "", errNotFound
+	s := &scan{
+		Path:    path,
+		ETag:    etag,
+		Commit:  prev.Commit,
+		RuleSet: prev.RuleSet,
+		Issues:  prev.Issues,
+		Links:   links,
 	}
+	s.Results, err = buildDocument(time.Now(), s, doc.Results)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	if res.StatusCode != 200 {
-		return nil, "", errors.Errorf("unable to process %s (%s)", repo, res.Status)
+// analyzeTree runs the analyzer over all packages of a source tree, as set
+// up by the configuration in its root. Paths in the results are relative to
+// the root of the tree.
+func (w *worker) analyzeTree(ctx context.Context, tree *sourceTree) (*analyzer, []*issue, error) {
+	cfg := readScanConfig(tree.dir)
+	if cfg.Error != "" {
+		logger.Printf("ignoring scan configuration: %s", cfg.Error)
 	}
+	tree.files = cfg.filter(tree)
 
-	unzipped, err := gzip.NewReader(res.Body)
+	analyzer := buildAnalyzer(cfg)
+	analyzer.importer = newSourceImporter(analyzer.fset, tree, w.moduleCache)
+	pkgs, err := analyzer.parsePackages(ctx, tree)
 	if err != nil {
-		return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+		return nil, nil, err
 	}
-
-	tar := tar.NewReader(unzipped)
-	for i := 0; i < archiveFileLimit; i++ {
-		// Refresh lock every minute
-		if time.Now().After(locked.Add(1 * time.Minute)) {
-			err = lock.refresh()
-			if err != nil {
-				return nil, "", errors.WrapPrefix(err, "lost lock, aborting", 0)
-			}
+	for _, pkg := range pkgs {
+		if err := analyzer.checkPackage(ctx, pkg); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		header, err := tar.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
+	issues := make([]*issue, len(analyzer.Issues))
+	for i, found := range analyzer.Issues {
+		if rel, err := filepath.Rel(tree.dir, found.File); err == nil {
+			found.File = filepath.ToSlash(rel)
 		}
-
-		path := filepath.Join(dir, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
-			}
-			continue
-		}
-
-		if !info.Mode().IsRegular() ||
-			!strings.HasSuffix(header.Name, ".go") ||
-			strings.Contains(header.Name, "vendor/") ||
-			strings.Contains(header.Name, "testdata/") ||
-			strings.HasSuffix(header.Name, "_test.go") {
-			continue
+		analyzer.Issues[i] = found
+		issues[i] = &issue{
+			Rule:       found.Rule,
+			File:       found.File,
+			Line:       found.Line,
+			Severity:   found.Severity.String(),
+			Confidence: found.Confidence.String(),
+			Details:    found.What,
+			Snippet:    found.Code,
 		}
+	}
+	return analyzer, issues, nil
+}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
-		}
-		defer file.Close()
+// buildDocument builds the response document for a scan. Documents are
+// stored gzip-compressed so they can be passed through to clients as is.
+func buildDocument(t time.Time, s *scan, results interface{}) ([]byte, error) {
+	_, ref := splitRef(s.Path)
+	doc := map[string]interface{}{
+		"time":    t,
+		"repo":    s.Path,
+		"ref":     ref,
+		"tag":     strings.Trim(s.ETag, `"`),
+		"commit":  s.Commit,
+		"rules":   s.RuleSet,
+		"results": results,
+	}
+	if s.Links != nil {
+		doc["links"] = s.Links
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "unable to build results document", 0)
+	}
 
-		_, err = io.Copy(file, tar)
-		if err != nil {
-			return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
-		}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(raw); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to compress results document", 0)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.WrapPrefix(err, "unable to compress results document", 0)
+	}
+	return buf.Bytes(), nil
+}
 
-		analyzer.Process(path)
-		if err != nil {
-			return nil, "", errors.WrapPrefix(err, fmt.Sprintf("unable to process %s", repo), 0)
-		}
+func writeResults(resp http.ResponseWriter, req *http.Request, t time.Time, s *scan) {
+	if s.Missing {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-		os.Remove(path)
+	if len(s.Results) == 0 {
+		resp.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	for i, issue := range analyzer.Issues {
-		issue.File = strings.SplitN(strings.Replace(issue.File, dir, "", -1), "/", 3)[2]
-		analyzer.Issues[i] = issue
+	lifetime := t.Add(1*time.Hour).Sub(time.Now()) / time.Second
+	if lifetime < 0 {
+		lifetime = 0
 	}
 
-	logger.Printf("node %s done processing %s", nodeID, repo)
-	return analyzer, res.Header.Get("ETag"), nil
+	resp.Header().Set("Cache-Control", fmt.Sprintf("max-age:%d", lifetime))
+	writeDocument(resp, req, s.Results)
 }
 
-func writeResults(resp http.ResponseWriter, t time.Time, path, tag, res string, missing bool) {
-	if missing {
-		resp.WriteHeader(http.StatusNotFound)
+// writeDocument writes a compressed results document, decompressing it
+// only if the client can't handle gzip or only some rules were selected.
+func writeDocument(resp http.ResponseWriter, req *http.Request, doc []byte) {
+	sel, err := parseRuleSelection(req.URL.Query())
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if res == "" {
-		resp.WriteHeader(http.StatusNotFound)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Vary", "Accept-Encoding")
+
+	// Documents are stored compressed, pass them through if possible
+	if sel == nil && acceptsGzip(req) {
+		resp.Header().Set("Content-Encoding", "gzip")
+		resp.WriteHeader(http.StatusOK)
+		resp.Write(doc)
 		return
 	}
 
-	results := map[string]interface{}{}
-	err := json.Unmarshal([]byte(res), &results)
+	unzipped, err := gzip.NewReader(bytes.NewReader(doc))
+	if err == nil {
+		doc, err = ioutil.ReadAll(unzipped)
+	}
+	if err == nil && sel != nil {
+		doc, err = filterDocument(doc, sel)
+	}
 	if err != nil {
-		logger.Printf("invalid JSON document at path %s", path)
+		logError("invalid results document", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	lifetime := t.Add(1*time.Hour).Sub(time.Now()) / time.Second
-	if lifetime < 0 {
-		lifetime = 0
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(doc)
+}
+
+// filterDocument drops the issues of rules that aren't selected from an
+// uncompressed results document. Everything else is left as it is, apart
+// from the number of issues found.
+func filterDocument(doc []byte, sel *ruleSelection) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, errors.New(err)
+	}
+	var results map[string]json.RawMessage
+	if err := json.Unmarshal(fields["results"], &results); err != nil || results == nil {
+		// Nothing to filter
+		return doc, nil
 	}
 
-	resp.Header().Set("Content-Type", "application/json")
-	resp.Header().Set("Cache-Control", fmt.Sprintf("max-age:%d", lifetime))
-	raw, _ := json.Marshal(map[string]interface{}{
-		"time":    t,
-		"repo":    path,
-		"tag":     strings.Trim(tag, `"`),
-		"results": results,
-	})
-	resp.WriteHeader(http.StatusOK)
-	resp.Write(raw)
+	var issues []json.RawMessage
+	if err := json.Unmarshal(results["issues"], &issues); err != nil {
+		return nil, errors.New(err)
+	}
+	kept := []json.RawMessage{}
+	for _, raw := range issues {
+		var i struct {
+			Rule string `json:"rule"`
+		}
+		if err := json.Unmarshal(raw, &i); err != nil {
+			return nil, errors.New(err)
+		}
+		if sel.enabled(i.Rule) {
+			kept = append(kept, raw)
+		}
+	}
+
+	var metrics map[string]json.RawMessage
+	if err := json.Unmarshal(results["metrics"], &metrics); err == nil && metrics != nil {
+		metrics["found"] = json.RawMessage(strconv.Itoa(len(kept)))
+		results["metrics"], _ = json.Marshal(metrics)
+	}
+	results["issues"], _ = json.Marshal(kept)
+	fields["results"], _ = json.Marshal(results)
+
+	filtered, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	return filtered, nil
 }
 
 func (w *worker) serveResults(resp http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	user := vars["user"]
-	repo := vars["repo"]
+	path := requestPath(req)
+
+	// Don't scan anything for a request that can't be served
+	if _, err := parseRuleSelection(req.URL.Query()); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	path := fmt.Sprintf("github.com/%s/%s", user, repo)
+	if w.servePrivateResults(resp, req, path) {
+		return
+	}
 
-	if !w.queueRequest(user, repo) {
+	if !w.queueRequest(path) {
 		resp.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	t1, tag, res, missing, err := w.db.fetchResults(path)
+	s1, err := w.db.fetchResults(path)
 	if err != nil && err != sql.ErrNoRows {
 		logError(fmt.Sprintf("unable to fetch results for path %s", path), err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if time.Now().Before(t1.Add(1*time.Hour)) && err == nil {
-		writeResults(resp, t1, path, tag, res, missing)
+	if err == nil && time.Now().Before(s1.Checked.Add(1*time.Hour)) {
+		writeResults(resp, req, s1.Checked, s1)
 		return
 	}
 
 	// Wait for at most 20 seconds for results to appear
 	for i := 0; i < 20; i++ {
-		t2, tag, res, missing, err := w.db.fetchResults(path)
+		s2, err := w.db.fetchResults(path)
 		if err != nil && err != sql.ErrNoRows {
 			logError(fmt.Sprintf("unable to fetch results for path %s", path), err)
 			resp.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if err == sql.ErrNoRows || t1.Equal(t2) {
+		if err == sql.ErrNoRows || (s1 != nil && s1.Checked.Equal(s2.Checked)) {
 			// No new results yet
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		writeResults(resp, t2, path, tag, res, missing)
+		writeResults(resp, req, s2.Checked, s2)
 		return
 	}
 
 	resp.WriteHeader(http.StatusServiceUnavailable)
 }
+
+func (w *worker) serveHistory(resp http.ResponseWriter, req *http.Request) {
+	path := requestPath(req)
+
+	scans, err := w.db.listScans(path, historyLimit)
+	if err != nil {
+		logError(fmt.Sprintf("unable to list scans for path %s", path), err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	history := []map[string]interface{}{}
+	for _, s := range scans {
+		history = append(history, map[string]interface{}{
+			"id":      s.ID,
+			"time":    s.Timestamp,
+			"tag":     strings.Trim(s.ETag, `"`),
+			"commit":  s.Commit,
+			"rules":   s.RuleSet,
+			"missing": s.Missing,
+		})
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	raw, _ := json.Marshal(map[string]interface{}{
+		"repo":  path,
+		"scans": history,
+	})
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(raw)
+}
+
+func (w *worker) serveScan(resp http.ResponseWriter, req *http.Request) {
+	path := requestPath(req)
+
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s, err := w.db.fetchScan(path, id)
+	if err == sql.ErrNoRows {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(fmt.Sprintf("unable to fetch scan %d for path %s", id, path), err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeResults(resp, req, s.Timestamp, s)
+}
@@ -0,0 +1,457 @@
+// Copyright (c) 2016, Cedric Staub <css@css.bio>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const insecureSource = `package main
+
+import (
+	"crypto/md5"
+	"fmt"
+)
+
+func main() {
+	fmt.Println(md5.Sum([]byte("test")))
+}
+`
+
+// testSources are the files of a repository with a single finding in
+// main.go. Vendored code and tests must not be analysed.
+var testSources = map[string]string{
+	"main.go":                    insecureSource,
+	"main_test.go":               insecureSource,
+	"vendor/example.com/x/x.go":  insecureSource,
+	"internal/util/util.go":      "package util\n",
+	"internal/util/broken.go":    "package util\nfunc {",
+	"testdata/fixtures/fixed.go": insecureSource,
+}
+
+func newTestWorker(hosts map[string]host) *worker {
+	return &worker{
+		db:           newMemoryDatabase(),
+		reqs:         make(chan string, 10),
+		hosts:        hosts,
+		lockLifetime: time.Minute,
+		lockRefresh:  time.Second,
+		held:         map[string]bool{},
+		access:       map[string]accessCheck{},
+		private:      make(chan struct{}, 1),
+	}
+}
+
+// buildTarball builds a gzip-compressed tarball like the ones served by
+// GitHub, with all files below root and the commit in a global header.
+func buildTarball(t *testing.T, root, commit string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	if commit != "" {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": commit},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     root + "/" + name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildZip builds a zip archive like the ones served by GitHub, with all
+// files below root and the commit in the archive comment.
+func buildZip(t *testing.T, root, commit string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	if root != "" {
+		root += "/"
+	}
+	for name, content := range files {
+		f, err := zw.Create(root + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.SetComment(commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkScan verifies the stored results for a repository made of
+// testSources.
+func checkScan(t *testing.T, db database, path, commit string) {
+	s, err := db.fetchResults(path)
+	if err != nil {
+		t.Fatalf("no results stored for %s: %v", path, err)
+	}
+	if s.Commit != commit {
+		t.Errorf("expected commit %q, got %q", commit, s.Commit)
+	}
+
+	issues, err := db.queryIssues(issueFilter{Repo: path}, issueLimit)
+	if err != nil || len(issues) == 0 {
+		t.Fatalf("expected issues in main.go (%v)", err)
+	}
+	for _, i := range issues {
+		if i.File != "main.go" {
+			t.Errorf("unexpected issue in %s", i.File)
+		}
+	}
+}
+
+func TestWorkerGitHub(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	archive := buildTarball(t, "user-repo-0123456", commit, testSources)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/repos/user/repo/tarball":
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				resp.WriteHeader(http.StatusNotModified)
+				return
+			}
+			resp.Header().Set("ETag", `"v1"`)
+			if req.Method == "GET" {
+				resp.Write(archive)
+			}
+		case "/repos/user/repo/commits/HEAD":
+			resp.Write([]byte(commit))
+		case "/repos/user/repo":
+			resp.Write([]byte(`{"private":false}`))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	github, err := newGitHubHost(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWorker(map[string]host{"github.com": github})
+
+	if err := w.process("node", "github.com/user/repo"); err != nil {
+		t.Fatalf("unable to process repository: %v", err)
+	}
+	checkScan(t, w.db, "github.com/user/repo", commit)
+
+	if _, err := w.analyze(context.Background(), "node", "github.com/user/repo", `"v1"`); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+
+	if err := w.process("node", "github.com/user/missing"); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+	if s, err := w.db.fetchResults("github.com/user/missing"); err != nil || !s.Missing {
+		t.Fatalf("expected missing repository to be recorded (%v)", err)
+	}
+}
+
+func TestWorkerReuse(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	archive := buildTarball(t, "user-repo-0123456", commit, testSources)
+
+	// A fork at the same commit as the repository
+	downloads := map[string]int{}
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/repos/user/repo/tarball", "/repos/fork/repo/tarball":
+			resp.Header().Set("ETag", `"`+strings.Split(req.URL.Path, "/")[2]+`"`)
+			if req.Method == "GET" {
+				mu.Lock()
+				downloads[req.URL.Path]++
+				mu.Unlock()
+				resp.Write(archive)
+			}
+		case "/repos/user/repo/commits/HEAD", "/repos/fork/repo/commits/HEAD":
+			resp.Write([]byte(commit))
+		case "/repos/user/repo", "/repos/fork/repo":
+			resp.Write([]byte(`{"private":false}`))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	github, _ := newGitHubHost(srv.URL, nil)
+	w := newTestWorker(map[string]host{"github.com": github})
+
+	for _, path := range []string{"github.com/user/repo", "github.com/fork/repo"} {
+		if err := w.process("node", path); err != nil {
+			t.Fatalf("unable to process %s: %v", path, err)
+		}
+		checkScan(t, w.db, path, commit)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if downloads["/repos/user/repo/tarball"] != 1 || downloads["/repos/fork/repo/tarball"] != 0 {
+		t.Fatalf("expected only the first repository to be downloaded, got %v", downloads)
+	}
+
+	// The fork has results and history of its own
+	s, err := w.db.fetchResults("github.com/fork/repo")
+	if err != nil || s.ETag != `"fork"` {
+		t.Fatalf("unexpected results %+v (%v)", s, err)
+	}
+	unzipped, err := gzip.NewReader(bytes.NewReader(s.Results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Repo  string    `json:"repo"`
+		Links repoLinks `json:"links"`
+	}
+	if err := json.NewDecoder(unzipped).Decode(&doc); err != nil || doc.Repo != "github.com/fork/repo" {
+		t.Errorf("results document not rewritten for the fork: %q (%v)", doc.Repo, err)
+	}
+	if doc.Links.Repo != "https://github.com/fork/repo" {
+		t.Errorf("unexpected links %+v", doc.Links)
+	}
+	scans, err := w.db.listScans("github.com/fork/repo", historyLimit)
+	if err != nil || len(scans) != 1 {
+		t.Fatalf("expected one scan in the history of the fork, got %d (%v)", len(scans), err)
+	}
+}
+
+func TestWorkerLocal(t *testing.T) {
+	root, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for name, content := range testSources {
+		path := filepath.Join(root, "dir", "project", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Commits claimed by archives on disk are not trusted
+	archive := buildTarball(t, "project-89abcde", "89abcdef0123456789abcdef0123456789abcdef", testSources)
+	if err := ioutil.WriteFile(filepath.Join(root, "archive.tar.gz"), archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newTestWorker(map[string]host{"local": newLocalHost("local", root)})
+
+	if err := w.process("node", "local/dir/project"); err != nil {
+		t.Fatalf("unable to process directory: %v", err)
+	}
+	checkScan(t, w.db, "local/dir/project", "")
+
+	if err := w.process("node", "local/archive"); err != nil {
+		t.Fatalf("unable to process tarball: %v", err)
+	}
+	checkScan(t, w.db, "local/archive", "89abcde")
+	if _, err := w.db.findScanByCommit("89abcdef0123456789abcdef0123456789abcdef", ruleSetVersion()); err != sql.ErrNoRows {
+		t.Errorf("expected no reusable scan, got %v", err)
+	}
+
+	s, _ := w.db.fetchResults("local/archive")
+	if _, err := w.analyze(context.Background(), "node", "local/archive", s.ETag); err != errNotModified {
+		t.Fatalf("expected errNotModified, got %v", err)
+	}
+	if _, err := w.analyze(context.Background(), "node", "local/missing", ""); err != errNotFound {
+		t.Fatalf("expected errNotFound, got %v", err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	for name, archive := range map[string][]byte{
+		"tarball":          buildTarball(t, "user-repo-0123456", commit, testSources),
+		"zipball":          buildZip(t, "user-repo-0123456", commit, testSources),
+		"zip without root": buildZip(t, "", "", testSources),
+		"invalid comment":  buildTarball(t, "user-repo-0123456", "not a commit", testSources),
+	} {
+		dir, err := ioutil.TempDir("", "gas-web-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		tree, err := extractArchive(context.Background(), bytes.NewReader(archive), dir)
+		if err != nil {
+			t.Fatalf("unable to extract %s: %v", name, err)
+		}
+
+		files := map[string]bool{}
+		for _, f := range tree.files {
+			files[filepath.ToSlash(f)] = true
+			if _, err := os.Stat(filepath.Join(tree.dir, f)); err != nil {
+				t.Errorf("%s: missing %s", name, f)
+			}
+		}
+		if len(files) != 3 || !files["main.go"] || !files["internal/util/util.go"] || !files["internal/util/broken.go"] {
+			t.Errorf("%s: unexpected files %v", name, tree.files)
+		}
+		if name == "invalid comment" && tree.commit != "" {
+			t.Errorf("%s: unexpected commit %q", name, tree.commit)
+		}
+		if name != "zip without root" && name != "invalid comment" && (tree.commit != commit || tree.abbrev != "0123456") {
+			t.Errorf("%s: unexpected commit %q (%q)", name, tree.commit, tree.abbrev)
+		}
+	}
+}
+
+func TestExtractArchiveRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gas-web-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	evil := map[string]string{"../../evil.go": "package evil\n"}
+	for _, archive := range [][]byte{buildTarball(t, "root", "", evil), buildZip(t, "root", "", evil)} {
+		if _, err := extractArchive(context.Background(), bytes.NewReader(archive), dir); err == nil {
+			t.Fatal("expected archive with path traversal to be rejected")
+		}
+	}
+
+	// Highly compressible files can't fill the disk
+	bomb := map[string]string{"bomb.go": "package bomb\n" + strings.Repeat(" ", archiveFileSize)}
+	for _, archive := range [][]byte{buildTarball(t, "root", "", bomb), buildZip(t, "root", "", bomb)} {
+		if len(archive) > archiveFileSize/100 {
+			t.Fatalf("archive of %d bytes is not compressed", len(archive))
+		}
+		if _, err := extractArchive(context.Background(), bytes.NewReader(archive), dir); err != errArchiveTooLarge {
+			t.Fatalf("expected errArchiveTooLarge, got %v", err)
+		}
+	}
+
+	if _, err := extractArchive(context.Background(), bytes.NewReader([]byte("text")), dir); err != errUnsupportedArchive {
+		t.Fatalf("expected errUnsupportedArchive, got %v", err)
+	}
+}
+
+func TestRuleSelection(t *testing.T) {
+	a := buildAnalyzer(defaultScanConfig())
+	analyzeSources(t, a, testSources)
+	doc, err := buildDocument(time.Now(), &scan{Path: "github.com/user/repo"}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scan{Results: doc}
+
+	for query, expected := range map[string]string{
+		"":                                "G401,G501",
+		"?include=g401":                   "G401",
+		"?exclude=G401":                   "G501",
+		"?include=G401,G501&exclude=G501": "G401",
+		"?include=G101":                   "",
+	} {
+		req := httptest.NewRequest("GET", "/results/github.com/user/repo"+query, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		writeResults(rec, req, time.Now(), s)
+
+		body := rec.Body.Bytes()
+		if rec.Header().Get("Content-Encoding") == "gzip" {
+			unzipped, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(unzipped)
+		}
+
+		var res struct {
+			Results struct {
+				Issues []struct {
+					Rule string `json:"rule"`
+				} `json:"issues"`
+				Metrics struct {
+					Found int `json:"found"`
+				} `json:"metrics"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+
+		rules := map[string]bool{}
+		for _, i := range res.Results.Issues {
+			rules[i.Rule] = true
+		}
+		ids := []string{}
+		for id := range rules {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, ",") != expected || res.Results.Metrics.Found != len(res.Results.Issues) {
+			t.Errorf("%s: expected %s, got %v (found %d)", query, expected, ids, res.Results.Metrics.Found)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	writeResults(rec, httptest.NewRequest("GET", "/results/github.com/user/repo?exclude=G999", nil), time.Now(), s)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown rule to be rejected, got %d", rec.Code)
+	}
+}